@@ -0,0 +1,126 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/blob"
+	"watchlogs/cmd/internal/bloom"
+	"watchlogs/cmd/internal/crypt"
+)
+
+// bloomRate is the false positive rate segment bloom filters are sized for.
+const bloomRate = 0.01
+
+// BloomPath returns the path of the bloom filter sidecar of segment id.
+func BloomPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("seg-%06d.bloom", id))
+}
+
+// TokenSet is a set of tokens a query can be checked against, such as the
+// bloom filter of a segment.
+type TokenSet interface {
+	Test(token string) bool
+}
+
+// IndexTokens is the exact token set of a segment's index.
+type IndexTokens map[string]*app.PostingList
+
+func (t IndexTokens) Test(token string) bool {
+	_, ok := t[token]
+	return ok
+}
+
+// indexBloom builds a bloom filter over the tokens in the index of seg.
+func indexBloom(seg *app.Segment) *bloom.Filter {
+	f := bloom.New(len(seg.Index), bloomRate)
+	for token := range seg.Index {
+		f.Add(token)
+	}
+	return f
+}
+
+// writeBloom stores f as the bloom sidecar of segment id.
+func writeBloom(dir string, id int, f *bloom.Filter, keys *crypt.Keyring) error {
+	data, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return WriteSidecar(BloomPath(dir, id), data, keys)
+}
+
+// buildBloom writes the bloom sidecar of segment id from the tokens in its
+// file, for segments rewritten without their index in memory.
+func buildBloom(dir string, id int, keys *crypt.Keyring) error {
+	src, err := os.Open(SegmentPath(dir, id))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	seg := &app.Segment{}
+	if err := ReadSegmentFrom(seg, src, nil, nil, keys); err != nil {
+		return err
+	}
+	return writeBloom(dir, id, indexBloom(seg), keys)
+}
+
+// LoadBloom reads the bloom filter of segment id, from local disk or, for
+// a segment only in the blob store, from there. It returns nil without an
+// error when the segment has no filter.
+func LoadBloom(ctx context.Context, a *app.App, id int) (*bloom.Filter, error) {
+	path := BloomPath(a.Cfg.DataPath, id)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if _, serr := os.Stat(SegmentPath(a.Cfg.DataPath, id)); serr == nil || a.Blobs == nil {
+			return nil, nil
+		}
+		data, err = readBlob(ctx, a.Blobs, blobKey(filepath.Base(path)))
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err = openSidecar(data, a.Keys); err != nil {
+		return nil, err
+	}
+	f := &bloom.Filter{}
+	if err := f.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func readBlob(ctx context.Context, store blob.Store, key string) ([]byte, error) {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// removeSidecars removes the sidecar files left by segment id once its log
+// file is gone.
+func removeSidecars(dir string, id int) {
+	names, err := segmentFiles(dir, id)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if name == filepath.Base(SegmentPath(dir, id)) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s: %v\n", name, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package helper
+
+import (
+	"context"
+	"os"
+	"testing"
+	"watchlogs/cmd/internal/app"
+)
+
+func TestMayMatch(t *testing.T) {
+	set := IndexTokens{"db": nil, "timeout": nil, "retry": nil}
+	for query, want := range map[string]bool{
+		"":                     true,
+		"db timeout":           true,
+		"db payment":           false,
+		"db OR payment":        true,
+		"payment OR card":      false,
+		"NOT payment":          true,
+		"level:error payment":  false,
+		"level:error db":       true,
+		`"db timeout"`:         true,
+		`"payment timeout"`:    false,
+		"(card OR db) -retry":  true,
+		"(card OR cash) retry": false,
+	} {
+		q, err := ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.MayMatch(set); got != want {
+			t.Errorf("%q: expected %v, got %v", query, want, got)
+		}
+	}
+}
+
+func TestSegmentBloom(t *testing.T) {
+	dir := t.TempDir()
+	a := &app.App{Cfg: app.Config{DataPath: dir}}
+	writeSegment(t, dir, 1, app.LogEntry{Message: "payment failed"}, app.LogEntry{Message: "cache warmed"})
+	writeSegment(t, dir, 2, app.LogEntry{Message: "no filter yet"})
+
+	if err := buildBloom(dir, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := LoadBloom(context.Background(), a, 1)
+	if err != nil || f == nil {
+		t.Fatalf("expected bloom filter of segment 1, got %v", err)
+	}
+	for _, token := range []string{"payment", "failed", "cache", "warmed"} {
+		if !f.Test(token) {
+			t.Errorf("expected %q in the filter", token)
+		}
+	}
+	if f.FalsePositiveRate() > bloomRate {
+		t.Errorf("expected false positive rate within %v, got %v", bloomRate, f.FalsePositiveRate())
+	}
+	if f, err := LoadBloom(context.Background(), a, 2); f != nil || err != nil {
+		t.Errorf("expected no filter for segment 2, got %v, %v", f, err)
+	}
+
+	// Sidecars go with their segment
+	os.Remove(SegmentPath(dir, 1))
+	removeSidecars(dir, 1)
+	if _, err := os.Stat(BloomPath(dir, 1)); !os.IsNotExist(err) {
+		t.Error("expected bloom filter removed with its segment")
+	}
+}
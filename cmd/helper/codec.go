@@ -0,0 +1,232 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"watchlogs/cmd/internal/crypt"
+)
+
+// activeKey returns the ID of the key new segments are sealed with, empty
+// when encryption is off.
+func activeKey(keys *crypt.Keyring) string {
+	if keys == nil {
+		return ""
+	}
+	return keys.Active()
+}
+
+// segmentHeader is the first line of an encrypted segment file; every
+// following line is one entry sealed with Key, base64 encoded. Plaintext
+// segments have no header and hold one JSON entry per line.
+type segmentHeader struct {
+	Format string `json:"watchlogs"`
+	Cipher string `json:"cipher"`
+	Key    string `json:"key"`
+}
+
+const headerFormat = "encrypted-segment"
+
+var headerPrefix = []byte(`{"watchlogs":`)
+
+func headerLine(keyID string) []byte {
+	data, _ := json.Marshal(segmentHeader{Format: headerFormat, Cipher: "aes-gcm", Key: keyID})
+	return append(data, '\n')
+}
+
+// parseHeader returns the key ID of a segment header line.
+func parseHeader(line []byte) (string, bool) {
+	if !bytes.HasPrefix(line, headerPrefix) {
+		return "", false
+	}
+	var h segmentHeader
+	if json.Unmarshal(line, &h) != nil || h.Format != headerFormat || h.Key == "" {
+		return "", false
+	}
+	return h.Key, true
+}
+
+// segmentKeyID returns the key the segment file at path is encrypted with,
+// empty for plaintext or empty files.
+func segmentKeyID(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadBytes('\n')
+	id, _ := parseHeader(bytes.TrimSuffix(line, []byte("\n")))
+	return id
+}
+
+// checkKey returns an error unless key id of a segment header is in keys.
+func checkKey(id string, keys *crypt.Keyring) error {
+	if keys.Has(id) {
+		return nil
+	}
+	return fmt.Errorf("segment is encrypted with key %q, which is not loaded", id)
+}
+
+// encodeLine turns the JSON of an entry into a segment line, sealed with
+// keyID of keys unless keyID is empty.
+func encodeLine(keyID string, data []byte, keys *crypt.Keyring) ([]byte, error) {
+	if keyID == "" {
+		return append(data, '\n'), nil
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("segment is encrypted with key %q but no keys are loaded", keyID)
+	}
+	sealed, err := keys.Seal(keyID, data)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %v", keyID, err)
+	}
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(sealed))+1)
+	base64.StdEncoding.Encode(line, sealed)
+	line[len(line)-1] = '\n'
+	return line, nil
+}
+
+// decodeLine returns the JSON of a segment line without its newline.
+func decodeLine(keyID string, line []byte, keys *crypt.Keyring) ([]byte, error) {
+	if keyID == "" {
+		return line, nil
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("segment is encrypted with key %q but no keys are loaded", keyID)
+	}
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, line)
+	if err != nil {
+		return nil, err
+	}
+	return keys.Open(keyID, sealed[:n])
+}
+
+// lineReader reads the entry lines of a segment file, skipping the header
+// of encrypted segments and decrypting their lines.
+type lineReader struct {
+	scanner *bufio.Scanner
+	keys    *crypt.Keyring
+	keyID   string
+	started bool
+	line    []byte
+	err     error
+	fatal   error // the segment cannot be read at all
+	start   int64 // file offset of the current line
+	next    int64 // file offset of the line after it
+}
+
+func newLineReader(r io.Reader, keys *crypt.Keyring) *lineReader {
+	lr := &lineReader{scanner: bufio.NewScanner(r), keys: keys}
+	lr.scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	lr.scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			lr.start, lr.next = lr.next, lr.next+int64(advance)
+		}
+		return advance, token, err
+	})
+	return lr
+}
+
+// Scan advances to the next entry line. Its decoded JSON is then returned
+// by Bytes, which is nil if the line cannot be decrypted. A segment whose
+// header names a key that is not loaded stops the scan with an error.
+func (lr *lineReader) Scan() bool {
+	for lr.fatal == nil && lr.scanner.Scan() {
+		raw := lr.scanner.Bytes()
+		if !lr.started {
+			lr.started = true
+			if id, ok := parseHeader(raw); ok {
+				lr.keyID = id
+				lr.fatal = checkKey(id, lr.keys)
+				continue
+			}
+		}
+		lr.line, lr.err = decodeLine(lr.keyID, raw, lr.keys)
+		return true
+	}
+	return false
+}
+
+// Bytes returns the JSON of the current entry line.
+func (lr *lineReader) Bytes() []byte {
+	return lr.line
+}
+
+// Offset returns the file offset at which the current line starts.
+func (lr *lineReader) Offset() int64 {
+	return lr.start
+}
+
+// DecodeErr returns why the current line could not be decoded, if so.
+func (lr *lineReader) DecodeErr() error {
+	return lr.err
+}
+
+func (lr *lineReader) Err() error {
+	if lr.fatal != nil {
+		return lr.fatal
+	}
+	return lr.scanner.Err()
+}
+
+// lineWriter writes entry lines to a new segment file, sealed with the
+// active key when encryption is on.
+type lineWriter struct {
+	w     *bufio.Writer
+	keys  *crypt.Keyring
+	keyID string
+}
+
+// newLineWriter starts a segment file on w, writing the header first when
+// keys is set.
+func newLineWriter(w *bufio.Writer, keys *crypt.Keyring) *lineWriter {
+	lw := &lineWriter{w: w, keys: keys, keyID: activeKey(keys)}
+	if lw.keyID != "" {
+		w.Write(headerLine(lw.keyID))
+	}
+	return lw
+}
+
+// Write writes the JSON of one entry.
+func (lw *lineWriter) Write(data []byte) error {
+	line, err := encodeLine(lw.keyID, data, lw.keys)
+	if err != nil {
+		return err
+	}
+	_, err = lw.w.Write(line)
+	return err
+}
+
+// WriteSidecar writes data to the index sidecar at path through a
+// temporary file and a rename, sealed with the active key of keys when it
+// is set. A sealed sidecar starts with a segment header line.
+func WriteSidecar(path string, data []byte, keys *crypt.Keyring) error {
+	if id := activeKey(keys); id != "" {
+		sealed, err := keys.Seal(id, data)
+		if err != nil {
+			return err
+		}
+		data = append(headerLine(id), sealed...)
+	}
+	return replaceFile(path, data)
+}
+
+// openSidecar returns the contents of sidecar data, decrypting it if it
+// is sealed.
+func openSidecar(data []byte, keys *crypt.Keyring) ([]byte, error) {
+	first, rest, found := bytes.Cut(data, []byte("\n"))
+	id, ok := parseHeader(first)
+	if !found || !ok {
+		return data, nil
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("sidecar is encrypted with key %q but no keys are loaded", id)
+	}
+	return keys.Open(id, rest)
+}
@@ -0,0 +1,100 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/crypt"
+)
+
+func parseKeys(t *testing.T, keys string) *crypt.Keyring {
+	t.Helper()
+	k, err := crypt.Parse(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestEncryptedSegments(t *testing.T) {
+	dir := t.TempDir()
+	key1 := "k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	key2 := "k2:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	// Segment 1 predates encryption
+	writeSegment(t, dir, 1, app.LogEntry{Timestamp: time.Now(), Message: "legacy plaintext"})
+
+	a := &app.App{LogCh: make(chan app.LogEntry, 1), Keys: parseKeys(t, key1)}
+	seg, err := OpenSegment(2, dir, a.Keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.CurrentSegment = seg
+	if err := commit(a, app.LogEntry{Message: "customer 42 paid"}, []byte(`{"message":"customer 42 paid"}`)); err != nil {
+		t.Fatal(err)
+	}
+	seg.File.Close()
+
+	data, _ := os.ReadFile(SegmentPath(dir, 2))
+	if bytes.Contains(data, []byte("customer")) {
+		t.Fatal("expected the entry to be encrypted on disk")
+	}
+
+	// After rotating to k2, both older segments stay readable
+	keys := parseKeys(t, key2+","+key1)
+	for id, want := range map[int]string{1: "legacy plaintext", 2: "customer 42 paid"} {
+		seg := &app.Segment{}
+		if err := ReadSegment(seg, SegmentPath(dir, id), nil, nil, keys); err != nil {
+			t.Fatal(err)
+		}
+		if len(seg.Logs) != 1 || seg.Logs[0].Message != want {
+			t.Errorf("segment %d: expected %q, got %+v", id, want, seg.Logs)
+		}
+	}
+
+	// Rewrites seal with the active key
+	if _, _, err := rewriteSegment(SegmentPath(dir, 1), func(app.LogEntry) bool { return true }, true, keys); err != nil {
+		t.Fatal(err)
+	}
+	if id := segmentKeyID(SegmentPath(dir, 1)); id != "" {
+		t.Errorf("expected untouched segment to stay plaintext, got key %q", id)
+	}
+	rewriteSegment(SegmentPath(dir, 2), func(e app.LogEntry) bool { return false }, true, keys)
+	if id := segmentKeyID(SegmentPath(dir, 2)); id != "k2" {
+		t.Errorf("expected rewritten segment sealed with k2, got %q", id)
+	}
+
+	sidecar := filepath.Join(dir, "seg-000002.bloom")
+	if err := WriteSidecar(sidecar, []byte("bits"), keys); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := os.ReadFile(sidecar)
+	if got, err := openSidecar(sealed, keys); err != nil || string(got) != "bits" {
+		t.Errorf("expected sidecar round trip, got %q, %v", got, err)
+	}
+
+	// Without the keys the entries cannot be read, and saying so beats
+	// reading nothing
+	seg = &app.Segment{}
+	writeSegment(t, dir, 3)
+	os.WriteFile(SegmentPath(dir, 3), data, 0644)
+	if err := ReadSegment(seg, SegmentPath(dir, 3), nil, nil, nil); err == nil || len(seg.Logs) != 0 {
+		t.Errorf("expected an error and no entries without keys, got %v and %d entries", err, len(seg.Logs))
+	}
+	if _, err := DescribeSegment(dir, 3, true, parseKeys(t, key2)); err == nil {
+		t.Error("expected describing a segment sealed with a key not loaded to fail")
+	}
+	if _, err := Fsck(dir, true, nil); err == nil {
+		t.Error("expected fsck to stop rather than quarantine entries it cannot decrypt")
+	}
+	if _, _, err := rewriteSegment(SegmentPath(dir, 3), func(app.LogEntry) bool { return true }, true, nil); err == nil {
+		t.Error("expected rewriting a segment that cannot be decrypted to fail")
+	}
+	if after, _ := os.ReadFile(SegmentPath(dir, 3)); !bytes.Equal(after, data) {
+		t.Error("expected the segment to be left untouched")
+	}
+}
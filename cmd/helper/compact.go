@@ -0,0 +1,281 @@
+package helper
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+	"watchlogs/cmd/internal/app"
+)
+
+// compactionJournal records a merge between renaming the merged file into
+// place and removing its sources, so a crash in between can be finished
+// on startup instead of leaving entries duplicated.
+const compactionJournal = "compaction.json"
+
+type journal struct {
+	Target  int    `json:"target"`
+	Temp    string `json:"temp"`
+	Sources []int  `json:"sources"`
+}
+
+// Compactor merges small sealed segments every 15 minutes, see Compact.
+func Compactor(a *app.App) {
+	ticker := time.NewTicker(15 * time.Minute)
+	for range ticker.C {
+		Compact(a, time.Now())
+	}
+}
+
+// Compact merges runs of adjacent sealed segments smaller than half of
+// MaxSegSize into the first segment of the run, as long as the result
+// stays within MaxSegSize. Entries past their retention are dropped on the
+// way. Runs are either all in memory or all on disk only; merged in-memory
+// segments are re-indexed and swapped into App.Segments under App.Mu.
+func Compact(a *app.App, now time.Time) {
+	if a.Cfg.MaxSegSize <= 0 {
+		return
+	}
+	a.StorageMu.Lock()
+	defer a.StorageMu.Unlock()
+
+	ids, err := ListSegments(a.Cfg.DataPath)
+	if err != nil {
+		log.Printf("Failed to list segments for compaction: %v\n", err)
+		return
+	}
+	merged := false
+	defer func() {
+		if merged {
+			refreshManifest(a)
+		}
+	}()
+
+	a.Mu.Lock()
+	hot := make(map[int]bool, len(a.Segments))
+	for _, seg := range a.Segments {
+		hot[seg.Id] = true
+	}
+	currentID := -1
+	if a.CurrentSegment != nil {
+		currentID = a.CurrentSegment.Id
+	}
+	a.Mu.Unlock()
+
+	keep := Retained(a.Cfg, now)
+	var run []int
+	var runSize int64
+	flush := func() {
+		if len(run) > 1 {
+			if err := mergeSegments(a, run, hot[run[0]], keep); err != nil {
+				log.Printf("Failed to compact segments %v: %v\n", run, err)
+			} else {
+				merged = true
+			}
+		}
+		run, runSize = nil, 0
+	}
+
+	for _, id := range ids {
+		if currentID >= 0 && id >= currentID {
+			break
+		}
+		info, err := os.Stat(SegmentPath(a.Cfg.DataPath, id))
+		if err != nil || info.Size() >= a.Cfg.MaxSegSize/2 {
+			flush()
+			continue
+		}
+		if len(run) > 0 && (hot[id] != hot[run[0]] || runSize+info.Size() > a.Cfg.MaxSegSize) {
+			flush()
+		}
+		run = append(run, id)
+		runSize += info.Size()
+	}
+	flush()
+}
+
+// mergeSegments writes the entries of the segments in ids that keep
+// accepts into the first of them and removes the others.
+func mergeSegments(a *app.App, ids []int, inMemory bool, keep func(app.LogEntry) bool) error {
+	dir := a.Cfg.DataPath
+	tmp, err := os.CreateTemp(dir, ".compact-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	out := bufio.NewWriter(tmp)
+	lw := newLineWriter(out, a.Keys)
+	kept := 0
+	for _, id := range ids {
+		n, err := copyEntries(lw, SegmentPath(dir, id), keep)
+		if err != nil {
+			return err
+		}
+		kept += n
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	j := journal{Target: ids[0], Temp: filepath.Base(tmp.Name()), Sources: ids}
+	if err := writeJournal(dir, j); err != nil {
+		return err
+	}
+
+	// The filter of the target no longer covers it once the merged file
+	// is in place, and no filter is safe until a new one is written
+	if err := os.Remove(BloomPath(dir, ids[0])); err != nil && !os.IsNotExist(err) {
+		os.Remove(filepath.Join(dir, compactionJournal))
+		return err
+	}
+
+	a.Mu.Lock()
+	err = os.Rename(tmp.Name(), SegmentPath(dir, ids[0]))
+	if err == nil && inMemory {
+		swapMerged(a, ids, keep)
+	}
+	a.Mu.Unlock()
+	if err != nil {
+		os.Remove(filepath.Join(dir, compactionJournal))
+		return err
+	}
+
+	finishMerge(dir, j)
+	if !inMemory {
+		if err := buildBloom(dir, ids[0], a.Keys); err != nil {
+			log.Printf("Failed to rebuild the bloom filter of segment %d: %v\n", ids[0], err)
+		}
+	}
+	log.Printf("Compacted segments %v into segment %d with %d entries\n", ids, ids[0], kept)
+	return nil
+}
+
+// copyEntries copies the entries of the segment at path that keep accepts
+// to out, skipping unparsable ones, and returns how many it copied.
+func copyEntries(out *lineWriter, path string, keep func(app.LogEntry) bool) (int, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	n := 0
+	scanner := newLineReader(src, out.keys)
+	for scanner.Scan() {
+		if err := scanner.DecodeErr(); err != nil {
+			return n, err
+		}
+		var entry app.LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil || !keep(entry) {
+			continue
+		}
+		if err := out.Write(scanner.Bytes()); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// swapMerged replaces the in-memory segments in ids with one segment
+// mapped from the merged file, which holds their entries that keep
+// accepts. The caller must hold App.Mu.
+func swapMerged(a *app.App, ids []int, keep func(app.LogEntry) bool) {
+	merged := &app.Segment{Id: ids[0]}
+
+	var segments, sources []*app.Segment
+	var pats []int
+	for _, seg := range a.Segments {
+		if seg.Id < ids[0] || seg.Id > ids[len(ids)-1] {
+			segments = append(segments, seg)
+			continue
+		}
+		if len(sources) == 0 {
+			segments = append(segments, merged)
+		}
+		sources = append(sources, seg)
+		for id := 0; id < seg.Len(); id++ {
+			if !keep(seg.Entry(id)) {
+				continue
+			}
+			p := 0
+			if id < len(seg.Patterns) {
+				p = seg.Patterns[id]
+			}
+			pats = append(pats, p)
+		}
+	}
+
+	err := mapSegment(merged, SegmentPath(a.Cfg.DataPath, ids[0]), keep, replayPatterns(pats), a.Cfg.MaxPerToken, a.Keys)
+	if err != nil {
+		log.Printf("Failed to map compacted segment %d: %v\n", ids[0], err)
+	}
+	for _, seg := range sources {
+		releaseSegment(seg)
+	}
+	a.Segments = segments
+}
+
+func writeJournal(dir string, j journal) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, compactionJournal+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, compactionJournal))
+}
+
+// finishMerge removes the sources of a merge other than its target, then
+// the journal.
+func finishMerge(dir string, j journal) {
+	for _, id := range j.Sources {
+		if id == j.Target {
+			continue
+		}
+		if err := os.Remove(SegmentPath(dir, id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove compacted segment %d: %v\n", id, err)
+			return
+		}
+		removeSidecars(dir, id)
+	}
+	os.Remove(filepath.Join(dir, compactionJournal))
+}
+
+// RecoverCompaction finishes or rolls back a merge interrupted by a crash.
+// If the merged file was not renamed into place yet the sources are
+// intact and it is discarded, otherwise the leftover sources are removed.
+func RecoverCompaction(dir string) {
+	data, err := os.ReadFile(filepath.Join(dir, compactionJournal))
+	if err != nil {
+		return
+	}
+	var j journal
+	if err := json.Unmarshal(data, &j); err != nil || len(j.Sources) == 0 {
+		log.Printf("Ignoring unreadable compaction journal: %v\n", err)
+		os.Remove(filepath.Join(dir, compactionJournal))
+		return
+	}
+
+	tmp := filepath.Join(dir, j.Temp)
+	if _, err := os.Stat(tmp); err == nil {
+		log.Printf("Rolling back interrupted compaction of segments %v\n", j.Sources)
+		os.Remove(tmp)
+		os.Remove(filepath.Join(dir, compactionJournal))
+		return
+	}
+	log.Printf("Finishing interrupted compaction of segments %v\n", j.Sources)
+	finishMerge(dir, j)
+}
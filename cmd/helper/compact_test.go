@@ -0,0 +1,93 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"watchlogs/cmd/internal/app"
+)
+
+func writeSegment(t *testing.T, dir string, id int, entries ...app.LogEntry) {
+	t.Helper()
+	f, err := os.Create(SegmentPath(dir, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, e := range entries {
+		data, _ := json.Marshal(e)
+		f.Write(append(data, '\n'))
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	entry := func(msg string) app.LogEntry {
+		return app.LogEntry{Timestamp: now, Level: "info", Message: msg}
+	}
+
+	// Segments 1-2 are only on disk, 3-4 are sealed in memory, 5 is current
+	writeSegment(t, dir, 1, entry("disk one"))
+	writeSegment(t, dir, 2, entry("disk two"), app.LogEntry{Timestamp: now.Add(-48 * time.Hour), Message: "expired"})
+	a := &app.App{Cfg: app.Config{DataPath: dir, MaxSegSize: 4096, Retention: 24 * time.Hour}}
+	for id, msg := range map[int]string{3: "memory three", 4: "memory four", 5: "current five"} {
+		writeSegment(t, dir, id, entry(msg))
+		seg := &app.Segment{Id: id}
+		if err := ReadSegment(seg, SegmentPath(dir, id), nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		a.Segments = append(a.Segments, seg)
+	}
+	slices.SortFunc(a.Segments, func(x, y *app.Segment) int { return x.Id - y.Id })
+	a.CurrentSegment = a.Segments[2]
+
+	Compact(a, now)
+
+	if ids, _ := ListSegments(dir); !slices.Equal(ids, []int{1, 3, 5}) {
+		t.Fatalf("expected segments 1, 3 and 5 left, got %v", ids)
+	}
+
+	cold := &app.Segment{}
+	ReadSegment(cold, SegmentPath(dir, 1), nil, nil, nil)
+	if len(cold.Logs) != 2 || cold.Logs[1].Message != "disk two" {
+		t.Errorf("expected merged segment 1 without the expired entry, got %+v", cold.Logs)
+	}
+	if f, _ := LoadBloom(context.Background(), a, 1); f == nil || !f.Test("two") {
+		t.Error("expected bloom filter of merged segment 1 to cover segment 2")
+	}
+	if _, err := os.Stat(BloomPath(dir, 3)); err != nil {
+		t.Error("expected bloom filter written for merged in-memory segment 3")
+	}
+
+	if len(a.Segments) != 2 || a.Segments[0].Id != 3 || a.Segments[1] != a.CurrentSegment {
+		t.Fatalf("expected in-memory segments 3 and current, got %d", len(a.Segments))
+	}
+	if ids := a.Segments[0].Index["four"].IDs(); !slices.Equal(ids, []int{1}) {
+		t.Errorf("expected merged index to map four to ID 1, got %v", ids)
+	}
+	if a.Segments[0].Entry(1).Message != "memory four" {
+		t.Errorf("expected merged segment mapped from its file, got %+v", a.Segments[0].Entry(1))
+	}
+}
+
+func TestRecoverCompaction(t *testing.T) {
+	dir := t.TempDir()
+	for id := 1; id <= 3; id++ {
+		writeSegment(t, dir, id)
+	}
+	writeJournal(dir, journal{Target: 1, Temp: ".compact-1", Sources: []int{1, 2, 3}})
+
+	RecoverCompaction(dir)
+
+	if ids, _ := ListSegments(dir); !slices.Equal(ids, []int{1}) {
+		t.Errorf("expected interrupted merge to be finished, got %v", ids)
+	}
+	if _, err := os.Stat(filepath.Join(dir, compactionJournal)); !os.IsNotExist(err) {
+		t.Error("expected journal to be removed")
+	}
+}
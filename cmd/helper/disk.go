@@ -0,0 +1,134 @@
+package helper
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+	"watchlogs/cmd/internal/app"
+)
+
+// DiskUsage returns the total size of the files under dir, snapshots
+// included. A file hard-linked more than once, as segments kept by a
+// snapshot are, is counted once.
+func DiskUsage(dir string) (int64, error) {
+	var total int64
+	seen := make(map[fileID]bool)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if id, ok := fileIDOf(info); ok {
+				if seen[id] {
+					return nil
+				}
+				seen[id] = true
+			}
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// WatchDisk checks the disk usage of DataPath every ten seconds, see
+// CheckDisk.
+func WatchDisk(a *app.App) {
+	ticker := time.NewTicker(10 * time.Second)
+	for range ticker.C {
+		CheckDisk(a)
+	}
+}
+
+// CheckDisk evicts the oldest sealed segments while DataPath is over
+// DiskQuota and records usage and free space in the metrics. The disk is
+// marked low, which makes ingest refuse entries, when free space is under
+// MinFreeDisk or the quota cannot be met by eviction.
+func CheckDisk(a *app.App) {
+	used, err := DiskUsage(a.Cfg.DataPath)
+	if err != nil {
+		log.Printf("Failed to measure disk usage of %s: %v\n", a.Cfg.DataPath, err)
+		return
+	}
+	if a.Cfg.DiskQuota > 0 && used > a.Cfg.DiskQuota {
+		if freed := evictSegments(a, used-a.Cfg.DiskQuota); freed > 0 {
+			used -= freed
+			refreshManifest(a)
+		}
+	}
+
+	free, err := freeBytes(a.Cfg.DataPath)
+	if err != nil {
+		log.Printf("Failed to read free space of %s: %v\n", a.Cfg.DataPath, err)
+		free = -1
+	}
+
+	low := a.Cfg.DiskQuota > 0 && used > a.Cfg.DiskQuota ||
+		free >= 0 && a.Cfg.MinFreeDisk > 0 && free < a.Cfg.MinFreeDisk
+	atomic.StoreInt64(&a.Metrics.DiskUsed, used)
+	atomic.StoreInt64(&a.Metrics.DiskFree, free)
+
+	var flag int64
+	if low {
+		flag = 1
+	}
+	if atomic.SwapInt64(&a.Metrics.DiskLow, flag) != flag {
+		if low {
+			log.Printf("Disk low (used %d of quota %d, %d free), refusing ingest\n", used, a.Cfg.DiskQuota, free)
+		} else {
+			log.Println("Disk space recovered, accepting ingest")
+		}
+	}
+}
+
+// evictSegments removes the oldest sealed segments until at least need
+// bytes are freed, returning the bytes freed. The current segment is
+// never evicted, nor are segments a snapshot still links to, since
+// removing them would free nothing.
+func evictSegments(a *app.App, need int64) int64 {
+	ids, err := ListSegments(a.Cfg.DataPath)
+	if err != nil {
+		log.Printf("Failed to list segments for eviction: %v\n", err)
+		return 0
+	}
+
+	a.StorageMu.Lock()
+	defer a.StorageMu.Unlock()
+	a.Mu.Lock()
+	defer a.Mu.Unlock()
+
+	var freed int64
+	for _, id := range ids {
+		if freed >= need || a.CurrentSegment != nil && id >= a.CurrentSegment.Id {
+			break
+		}
+		path := SegmentPath(a.Cfg.DataPath, id)
+		info, err := os.Stat(path)
+		if err != nil || sharedFile(info) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to evict segment %d: %v\n", id, err)
+			continue
+		}
+		removeSidecars(a.Cfg.DataPath, id)
+		freed += info.Size()
+		log.Printf("Evicted segment %d (%d bytes) to stay within the disk quota\n", id, info.Size())
+
+		for i, seg := range a.Segments {
+			if seg.Id == id {
+				releaseSegment(seg)
+				a.Segments = append(a.Segments[:i], a.Segments[i+1:]...)
+				break
+			}
+		}
+	}
+	return freed
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package helper
+
+import "os"
+
+// freeBytes is not implemented on this platform; -1 means unknown, which
+// disables the MinFreeDisk watermark.
+func freeBytes(dir string) (int64, error) {
+	return -1, nil
+}
+
+type fileID struct{}
+
+// fileIDOf cannot identify files on this platform, so every link is
+// counted as a file of its own.
+func fileIDOf(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+func sharedFile(info os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,89 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"watchlogs/cmd/internal/app"
+)
+
+func TestCheckDiskEvictsOldestSegments(t *testing.T) {
+	dir := t.TempDir()
+	for id := 1; id <= 4; id++ {
+		if err := os.WriteFile(SegmentPath(dir, id), []byte(strings.Repeat("x", 100)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hot := &app.Segment{Id: 3}
+	current := &app.Segment{Id: 4}
+	a := &app.App{
+		Cfg:            app.Config{DataPath: dir, DiskQuota: 250},
+		Segments:       []*app.Segment{hot, current},
+		CurrentSegment: current,
+	}
+
+	CheckDisk(a)
+
+	ids, _ := ListSegments(dir)
+	if len(ids) != 2 || ids[0] != 3 {
+		t.Fatalf("expected segments 1 and 2 evicted, got %v", ids)
+	}
+	if a.Metrics.DiskUsed != 200 || a.Metrics.DiskLow != 0 {
+		t.Errorf("expected 200 bytes used and disk not low, got %d and %d", a.Metrics.DiskUsed, a.Metrics.DiskLow)
+	}
+
+	// Only the current segment is left to evict, which is never done
+	a.Cfg.DiskQuota = 50
+	CheckDisk(a)
+	ids, _ = ListSegments(dir)
+	if len(ids) != 1 || ids[0] != 4 || len(a.Segments) != 1 {
+		t.Fatalf("expected only the current segment left, got %v", ids)
+	}
+	if a.Metrics.DiskLow != 1 {
+		t.Error("expected disk marked low while over quota")
+	}
+}
+
+func TestDiskUsageCountsSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	for id := 1; id <= 3; id++ {
+		if err := os.WriteFile(SegmentPath(dir, id), []byte(strings.Repeat("x", 100)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := filepath.Join(dir, SnapshotDir, "nightly")
+	if err := os.MkdirAll(snap, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(SegmentPath(dir, 1), SegmentPath(snap, 1)); err != nil {
+		t.Skipf("hard links not supported: %v", err)
+	}
+	// A segment only the snapshot still holds
+	if err := os.WriteFile(SegmentPath(snap, 0), []byte(strings.Repeat("x", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	used, err := DiskUsage(dir)
+	if err != nil || used != 400 {
+		t.Fatalf("expected 400 bytes with the linked segment counted once, got %d (%v)", used, err)
+	}
+
+	current := &app.Segment{Id: 3}
+	a := &app.App{
+		Cfg:            app.Config{DataPath: dir, DiskQuota: 250},
+		Segments:       []*app.Segment{current},
+		CurrentSegment: current,
+	}
+	CheckDisk(a)
+
+	// Removing segment 1 would free nothing while the snapshot links it
+	ids, _ := ListSegments(dir)
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 3 {
+		t.Fatalf("expected only segment 2 evicted, got %v", ids)
+	}
+	if a.Metrics.DiskUsed != 300 || a.Metrics.DiskLow != 1 {
+		t.Errorf("expected 300 bytes used and disk low, got %d and %d", a.Metrics.DiskUsed, a.Metrics.DiskLow)
+	}
+}
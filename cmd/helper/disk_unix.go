@@ -0,0 +1,39 @@
+//go:build unix
+
+package helper
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeBytes returns the space available to unprivileged users on the
+// filesystem holding dir.
+func freeBytes(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// fileID identifies a file by device and inode, so hard links to it can
+// be told apart from copies.
+type fileID struct {
+	dev, ino uint64
+}
+
+func fileIDOf(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// sharedFile reports whether the file has other hard links, so removing
+// this one frees no space.
+func sharedFile(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
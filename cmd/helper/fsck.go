@@ -0,0 +1,302 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/crypt"
+)
+
+// QuarantineDir is where fsck --repair moves bad data, under DataPath.
+const QuarantineDir = "quarantine"
+
+// Kinds of problems found by Fsck.
+const (
+	ProblemTornTail   = "torn_tail"
+	ProblemUnparsable = "unparsable"
+	ProblemOutOfOrder = "out_of_order"
+	ProblemGap        = "gap"
+	ProblemOrphan     = "orphan"
+)
+
+// Problem is one issue found in a data directory. Segment is 0 for files
+// that do not belong to a segment.
+type Problem struct {
+	Kind    string `json:"kind"`
+	Segment int    `json:"segment,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Detail  string `json:"detail"`
+}
+
+func (p Problem) String() string {
+	where := ""
+	if p.Segment > 0 {
+		where = fmt.Sprintf("segment %d", p.Segment)
+		if p.Line > 0 {
+			where += fmt.Sprintf(" line %d", p.Line)
+		}
+		where += ": "
+	}
+	return fmt.Sprintf("%-12s %s%s", p.Kind, where, p.Detail)
+}
+
+// FsckReport is the outcome of Fsck.
+type FsckReport struct {
+	Segments int
+	Entries  int
+	Problems []Problem
+	Repaired []string
+}
+
+// Fsck checks the segments in dir for torn tails, unparsable lines,
+// out-of-order timestamps and missing segment IDs, and looks for orphaned
+// sidecar and temporary files. With repair set, torn tails are truncated,
+// unparsable lines and orphaned files are moved to QuarantineDir and the
+// manifest is rebuilt. It must not run on a directory a server is using.
+func Fsck(dir string, repair bool, keys *crypt.Keyring) (*FsckReport, error) {
+	ids, err := ListSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &FsckReport{Segments: len(ids)}
+
+	for _, id := range ids {
+		if err := fsckSegment(dir, id, repair, report, keys); err != nil {
+			return report, fmt.Errorf("segment %d: %v", id, err)
+		}
+	}
+	fsckGaps(dir, ids, report)
+	if err := fsckOrphans(dir, ids, repair, report); err != nil {
+		return report, err
+	}
+
+	if repair && len(report.Repaired) > 0 && len(ids) > 0 {
+		if err := RefreshManifest(dir, ids[len(ids)-1], keys); err != nil {
+			return report, err
+		}
+		report.Repaired = append(report.Repaired, "rebuilt "+ManifestFile)
+	}
+	return report, nil
+}
+
+func fsckSegment(dir string, id int, repair bool, report *FsckReport, keys *crypt.Keyring) error {
+	path := SegmentPath(dir, id)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var good, bad bytes.Buffer
+	var last time.Time
+	keyID := ""
+	outOfOrder, firstOutOfOrder := 0, 0
+	torn := false
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	for line := 1; ; line++ {
+		raw, err := r.ReadBytes('\n')
+		if len(raw) == 0 && err == io.EOF {
+			break
+		}
+		complete := err == nil
+		text := bytes.TrimSuffix(raw, []byte("\n"))
+
+		// Encrypted segments start with a header naming their key
+		if id, ok := parseHeader(text); ok && line == 1 && complete {
+			// Every line would look unparsable, and be quarantined
+			if err := checkKey(id, keys); err != nil {
+				return err
+			}
+			keyID = id
+			good.Write(raw)
+			continue
+		}
+
+		var entry app.LogEntry
+		parsed := false
+		if plain, err := decodeLine(keyID, text, keys); err == nil && len(text) > 0 {
+			parsed = json.Unmarshal(plain, &entry) == nil
+		}
+		switch {
+		case !complete:
+			torn = true
+			detail := fmt.Sprintf("%d bytes without a trailing newline", len(raw))
+			if parsed {
+				detail += ", entry is complete"
+				good.Write(text)
+				good.WriteByte('\n')
+				report.Entries++
+			}
+			report.Problems = append(report.Problems, Problem{Kind: ProblemTornTail, Segment: id, Line: line, Detail: detail})
+		case len(text) == 0:
+			// Blank lines carry nothing
+		case !parsed:
+			report.Problems = append(report.Problems, Problem{Kind: ProblemUnparsable, Segment: id, Line: line, Detail: preview(text)})
+			bad.Write(raw)
+		default:
+			report.Entries++
+			good.Write(raw)
+			if entry.Timestamp.Before(last) {
+				if outOfOrder++; outOfOrder == 1 {
+					firstOutOfOrder = line
+				}
+			} else {
+				last = entry.Timestamp
+			}
+		}
+		if !complete {
+			break
+		}
+	}
+
+	if outOfOrder > 0 {
+		report.Problems = append(report.Problems, Problem{
+			Kind: ProblemOutOfOrder, Segment: id, Line: firstOutOfOrder,
+			Detail: fmt.Sprintf("%d entries older than an entry before them", outOfOrder),
+		})
+	}
+
+	if !repair || (!torn && bad.Len() == 0) {
+		return nil
+	}
+	if bad.Len() > 0 {
+		qpath, err := quarantine(dir, filepath.Base(path)+".bad", bad.Bytes())
+		if err != nil {
+			return err
+		}
+		report.Repaired = append(report.Repaired, fmt.Sprintf("segment %d: moved %d bytes of unparsable lines to %s", id, bad.Len(), qpath))
+	}
+	if err := replaceFile(path, good.Bytes()); err != nil {
+		return err
+	}
+	if torn {
+		report.Repaired = append(report.Repaired, fmt.Sprintf("segment %d: repaired torn tail", id))
+	}
+	return nil
+}
+
+// fsckGaps reports segment IDs missing between the first and last segment
+// that the manifest does not account for. Compaction and eviction remove
+// segments deliberately and update the manifest as they do, and tiering
+// marks the segments it moves to the blob store as remote.
+func fsckGaps(dir string, ids []int, report *FsckReport) {
+	m, err := LoadManifest(dir)
+	if err != nil {
+		m = &Manifest{}
+	}
+	listed := make(map[int]bool, len(m.Segments))
+	for _, meta := range m.Segments {
+		listed[meta.Id] = !meta.Remote
+	}
+
+	for i := 1; i < len(ids); i++ {
+		for missing := ids[i-1] + 1; missing < ids[i]; missing++ {
+			if len(m.Segments) > 0 && !listed[missing] {
+				continue
+			}
+			report.Problems = append(report.Problems, Problem{Kind: ProblemGap, Segment: missing, Detail: "segment file is missing"})
+		}
+	}
+}
+
+// fsckOrphans reports files left behind in dir: segment sidecars whose
+// segment is gone and temporary files of interrupted rewrites.
+func fsckOrphans(dir string, ids []int, repair bool, report *FsckReport) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	exists := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		exists[id] = true
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		var id int
+		orphan := ""
+		switch {
+		case strings.HasPrefix(name, ".retention-"), strings.HasPrefix(name, ".compact-"), strings.HasPrefix(name, ".manifest-"), strings.HasPrefix(name, ".repair-"):
+			orphan = "temporary file of an interrupted rewrite"
+		case !strings.HasSuffix(name, ".log"):
+			if _, err := fmt.Sscanf(name, "seg-%06d.", &id); err == nil && !exists[id] {
+				orphan = fmt.Sprintf("index file of missing segment %d", id)
+			}
+		}
+		if orphan == "" {
+			continue
+		}
+		report.Problems = append(report.Problems, Problem{Kind: ProblemOrphan, Detail: name + ": " + orphan})
+
+		if repair {
+			qdir := filepath.Join(dir, QuarantineDir)
+			if err := os.MkdirAll(qdir, 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(filepath.Join(dir, name), filepath.Join(qdir, name)); err != nil {
+				return err
+			}
+			report.Repaired = append(report.Repaired, fmt.Sprintf("moved %s to %s", name, qdir))
+		}
+	}
+	return nil
+}
+
+// quarantine appends data to the file name in the quarantine directory of
+// dir and returns its path.
+func quarantine(dir, name string, data []byte) (string, error) {
+	qdir := filepath.Join(dir, QuarantineDir)
+	if err := os.MkdirAll(qdir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(qdir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return "", err
+	}
+	return path, f.Sync()
+}
+
+// replaceFile atomically replaces the contents of path.
+func replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".repair-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func preview(b []byte) string {
+	const n = 60
+	s := string(b)
+	if len(s) > n {
+		s = s[:n] + "..."
+	}
+	return fmt.Sprintf("%q", s)
+}
@@ -0,0 +1,60 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"watchlogs/cmd/internal/app"
+)
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	writeSegment(t, dir, 1,
+		app.LogEntry{Timestamp: now, Message: "second"},
+		app.LogEntry{Timestamp: now.Add(-time.Minute), Message: "first"},
+	)
+	writeSegment(t, dir, 3, app.LogEntry{Timestamp: now, Message: "kept"})
+	f, _ := os.OpenFile(SegmentPath(dir, 3), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("not json\n{\"message\":\"torn")
+	f.Close()
+	os.WriteFile(filepath.Join(dir, "seg-000009.bloom"), []byte("x"), 0644)
+
+	report, err := Fsck(dir, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, p := range report.Problems {
+		kinds = append(kinds, p.Kind)
+	}
+	want := []string{ProblemOutOfOrder, ProblemUnparsable, ProblemTornTail, ProblemGap, ProblemOrphan}
+	if !slices.Equal(kinds, want) {
+		t.Fatalf("expected problems %v, got %v", want, report.Problems)
+	}
+
+	if _, err := Fsck(dir, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(SegmentPath(dir, 3))
+	seg := &app.Segment{}
+	ReadSegment(seg, SegmentPath(dir, 3), nil, nil, nil)
+	if len(seg.Logs) != 1 || data[len(data)-1] != '\n' {
+		t.Errorf("expected segment 3 cut back to its valid entry, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, QuarantineDir, "seg-000003.log.bad")); err != nil {
+		t.Errorf("expected unparsable line quarantined: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, QuarantineDir, "seg-000009.bloom")); err != nil {
+		t.Errorf("expected orphan quarantined: %v", err)
+	}
+
+	// The rebuilt manifest accounts for the missing segment 2
+	report, _ = Fsck(dir, false, nil)
+	if len(report.Problems) != 1 || report.Problems[0].Kind != ProblemOutOfOrder {
+		t.Errorf("expected only out-of-order entries left, got %v", report.Problems)
+	}
+}
@@ -1,12 +1,17 @@
 package helper
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"time"
 	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/blob"
+	"watchlogs/cmd/internal/crypt"
 )
 
 func LoadConfig() app.Config {
@@ -17,6 +22,15 @@ func LoadConfig() app.Config {
 		}
 	}
 
+	var retentionRules []app.RetentionRule
+	if v := os.Getenv("RETENTION_RULES"); v != "" {
+		rules, err := ParseRetentionRules(v)
+		if err != nil {
+			log.Printf("Ignoring RETENTION_RULES: %v\n", err)
+		}
+		retentionRules = rules
+	}
+
 	maxRes := 100
 	if v := os.Getenv("MAX_RESULTS"); v != "" {
 		if n, err := strconv.Atoi(v); err == nil {
@@ -57,59 +71,262 @@ func LoadConfig() app.Config {
 		}
 	}
 
+	stopwords := DefaultStopwords
+	if v := os.Getenv("STOPWORDS"); v != "" {
+		stopwords = Tokenize(v)
+	}
+	stopSet := make(map[string]bool, len(stopwords))
+	for _, w := range stopwords {
+		stopSet[w] = true
+	}
+
+	maxQueryTime := 10 * time.Second
+	if v := os.Getenv("MAX_QUERY_TIME"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			maxQueryTime = d
+		}
+	}
+
+	alertRules := filepath.Join(path, "alert_rules.json")
+	if v := os.Getenv("ALERT_RULES"); v != "" {
+		alertRules = v
+	}
+
+	alertInterval := 15 * time.Second
+	if v := os.Getenv("ALERT_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			alertInterval = d
+		}
+	}
+
+	var diskQuota int64
+	if v := os.Getenv("DISK_QUOTA"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			diskQuota = n
+		}
+	}
+
+	minFreeDisk := int64(64 * 1024 * 1024) // Default 64 MB
+	if v := os.Getenv("MIN_FREE_DISK"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			minFreeDisk = n
+		}
+	}
+
+	var warmAge time.Duration
+	if v := os.Getenv("WARM_AGE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			warmAge = d
+		}
+	}
+
+	s3 := blob.S3Options{
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Region:    os.Getenv("S3_REGION"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+	}
+
 	return app.Config{
-		Retention:   ret,
-		MaxResults:  maxRes,
-		ChannelSize: chSize,
-		MaxPerToken: maxPerToken,
-		MaxSegSize:  maxSegSize,
-		DataPath:    path,
-		HotSegments: hotSegments,
+		Retention:      ret,
+		RetentionRules: retentionRules,
+		MaxResults:     maxRes,
+		ChannelSize:    chSize,
+		MaxPerToken:    maxPerToken,
+		MaxSegSize:     maxSegSize,
+		DataPath:       path,
+		HotSegments:    hotSegments,
+		Stopwords:      stopSet,
+		MaxQueryTime:   maxQueryTime,
+		AlertRules:     alertRules,
+		AlertInterval:  alertInterval,
+		DiskQuota:      diskQuota,
+		MinFreeDisk:    minFreeDisk,
+		WarmAge:        warmAge,
+		BlobStore:      os.Getenv("BLOB_STORE"),
+		S3:             s3,
+		KeyFile:        os.Getenv("ENCRYPTION_KEY_FILE"),
 	}
 }
 
+// DefaultStopwords are left out of term statistics unless STOPWORDS
+// overrides them with a comma separated list.
+var DefaultStopwords = []string{
+	"a", "an", "and", "are", "as", "at", "be", "by", "for", "from", "has",
+	"in", "is", "it", "of", "on", "or", "that", "the", "to", "was", "with",
+}
+
+// Span is a token together with its position in the original text.
+// Start and End are character (rune) offsets, End being exclusive.
+type Span struct {
+	Token string `json:"token"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
 func Tokenize(input string) []string {
 	var tokens []string
+	for _, span := range TokenSpans(input) {
+		tokens = append(tokens, span.Token)
+	}
+	return tokens
+}
+
+// TokenSpans splits input into lowercase tokens the same way Tokenize
+// does, keeping the offsets of each token.
+func TokenSpans(input string) []Span {
+	var spans []Span
 	current := ""
+	start := 0
+	pos := 0
 
 	for _, char := range input {
 		if char >= 'A' && char <= 'Z' {
 			char += 'a' - 'A' // Convert to lowercase
 		}
 		if char >= 'a' && char <= 'z' {
+			if current == "" {
+				start = pos
+			}
 			current += string(char)
 		} else {
 			if current != "" {
-				tokens = append(tokens, current)
+				spans = append(spans, Span{Token: current, Start: start, End: pos})
 				current = ""
 			}
 		}
+		pos++
 	}
 	if current != "" {
-		tokens = append(tokens, current)
+		spans = append(spans, Span{Token: current, Start: start, End: pos})
 	}
-	return tokens
+	return spans
 }
 
-func Intersect(a, b []int) []int {
-	var i = 0
-	var j = 0
-	var result []int
-
-	for i < len(a) && j < len(b) {
-		if a[i] == b[j] {
-			result = append(result, a[i])
-			i++
-			j++
-		} else if a[i] < b[j] {
-			i++
-		} else {
-			j++
+// Highlight returns the spans of message whose token is one of tokens.
+func Highlight(message string, tokens []string) []Span {
+	var spans []Span
+	for _, span := range TokenSpans(message) {
+		if slices.Contains(tokens, span.Token) {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// Intersect returns the IDs present in both lists. It walks the shorter
+// list and uses the skip pointers of the longer one to jump ahead.
+func Intersect(a, b *app.PostingList) *app.PostingList {
+	result, _ := IntersectContext(context.Background(), a, b)
+	return result
+}
+
+// intersectCheckEvery is how many IDs are compared between checks of the
+// context in IntersectContext.
+const intersectCheckEvery = 4096
+
+// IntersectContext is Intersect that stops early when ctx is done. It
+// then returns the IDs found so far together with the context error.
+func IntersectContext(ctx context.Context, a, b *app.PostingList) (*app.PostingList, error) {
+	if a.Len() > b.Len() {
+		a, b = b, a
+	}
+
+	result := &app.PostingList{}
+	if a.Len() == 0 {
+		return result, nil
+	}
+
+	small := a.Iterator()
+	large := b.Iterator()
+	n := 0
+	for id, ok := small.Next(); ok; id, ok = small.Next() {
+		if n++; n%intersectCheckEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
+		}
+		found, ok := large.SkipTo(id)
+		if !ok {
+			break
+		}
+		if found == id {
+			result.Add(id)
+		}
+	}
+	return result, nil
+}
+
+// Union returns the IDs present in either list. Nil lists are empty.
+func Union(a, b *app.PostingList) *app.PostingList {
+	result := &app.PostingList{}
+	ia, ib := a.Iterator(), b.Iterator()
+	x, okA := ia.Next()
+	y, okB := ib.Next()
+	for okA || okB {
+		switch {
+		case !okB || okA && x < y:
+			result.Add(x)
+			x, okA = ia.Next()
+		case !okA || y < x:
+			result.Add(y)
+			y, okB = ib.Next()
+		default:
+			result.Add(x)
+			x, okA = ia.Next()
+			y, okB = ib.Next()
+		}
+	}
+	return result
+}
+
+// Difference returns the IDs of a that are not in b.
+func Difference(a, b *app.PostingList) *app.PostingList {
+	result := &app.PostingList{}
+	ia, ib := a.Iterator(), b.Iterator()
+	for id, ok := ia.Next(); ok; id, ok = ia.Next() {
+		if found, ok := ib.SkipTo(id); !ok || found != id {
+			result.Add(id)
 		}
 	}
 	return result
 }
 
+// IndexEntry adds the tokens of entry to the segment's inverted index
+// under id, records the names of its fields and widens the segment's time
+// range. When maxPerToken is positive the oldest IDs are dropped to keep
+// each posting list bounded.
+func IndexEntry(seg *app.Segment, id int, entry app.LogEntry, maxPerToken int) {
+	if seg.MinTime.IsZero() || entry.Timestamp.Before(seg.MinTime) {
+		seg.MinTime = entry.Timestamp
+	}
+	if entry.Timestamp.After(seg.MaxTime) {
+		seg.MaxTime = entry.Timestamp
+	}
+	for name := range entry.Fields {
+		if seg.Fields == nil {
+			seg.Fields = make(map[string]bool)
+		}
+		seg.Fields[name] = true
+	}
+
+	tokens := Tokenize(entry.Message)
+	seg.Tokens += len(tokens)
+	for _, token := range tokens {
+		ids := seg.Index[token]
+		if ids == nil {
+			ids = &app.PostingList{}
+			seg.Index[token] = ids
+		}
+		if maxPerToken > 0 && ids.Len() >= maxPerToken {
+			if last, ok := ids.Last(); !ok || last != id {
+				ids.DropFirst() // Remove oldest ID to maintain size
+			}
+		}
+		ids.Add(id)
+	}
+}
+
 func ParseSince(since string) time.Time {
 	if since == "" {
 		log.Println("No 'since' parameter provided, returning zero time")
@@ -125,76 +342,59 @@ func ParseSince(since string) time.Time {
 	return time.Now().Add(-duration)
 }
 
+// ParseTime accepts either an RFC3339 timestamp or a duration meaning
+// that long ago. An empty value returns def.
+func ParseTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: want RFC3339 or a duration", v)
+	}
+	return time.Now().Add(-d), nil
+}
+
 func Cleanup(a *app.App) {
 	ticker := time.NewTicker(1 * time.Hour)
 
 	for range ticker.C {
 		log.Println("Starting cleanup goroutine...")
-		cutoff := time.Now().Add(-a.Cfg.Retention)
-
-		a.Mu.Lock()
-		var keptSegments []*app.Segment
-		for _, segment := range a.Segments {
-			shouldDelete := false
-			if len(segment.Logs) > 0 {
-				shouldDelete = segment.Logs[len(segment.Logs)-1].Timestamp.Before(cutoff)
-			} else if segment.File != nil {
-				if info, err := segment.File.Stat(); err == nil {
-					shouldDelete = info.ModTime().Before(cutoff)
-				}
-			}
-
-			if shouldDelete {
-				if segment.File != nil {
-					segment.File.Sync()
-					segment.File.Close()
-					_ = os.Remove(segment.File.Name())
-				}
-
-				if a.CurrentSegment == segment {
-					nextID := segment.Id + 1
-					newSeg, err := OpenSegment(nextID, a.Cfg.DataPath)
-					if err != nil {
-						log.Printf("Failed to open new segment after cleanup: %v\n", err)
-					} else {
-						a.CurrentSegment = newSeg
-						keptSegments = append(keptSegments, newSeg)
-					}
-				}
-				continue
-			}
-			keptSegments = append(keptSegments, segment)
-		}
-
-		if len(keptSegments) == 0 {
-			newSeg, err := OpenSegment(1, a.Cfg.DataPath)
-			if err != nil {
-				log.Printf("Failed to open fallback segment after cleanup: %v\n", err)
-			} else {
-				a.CurrentSegment = newSeg
-				keptSegments = append(keptSegments, newSeg)
-			}
-		}
-
-		a.Segments = keptSegments
-		a.Mu.Unlock()
+		ApplyRetention(a, time.Now())
+		Tier(a, time.Now())
 		log.Println("Cleanup completed.")
 	}
 	log.Println("Cleanup goroutine stopped.")
 }
 
-func OpenSegment(id int, path string) (*app.Segment, error) {
-	name := fmt.Sprintf("%s/seg-%06d.log", path, id)
-	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+func OpenSegment(id int, path string, keys *crypt.Keyring) (*app.Segment, error) {
+	f, err := os.OpenFile(SegmentPath(path, id), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
 
 	info, _ := f.Stat()
-	return &app.Segment{
+	seg := &app.Segment{
 		Id:    id,
 		File:  f,
 		Size:  info.Size(),
-		Index: make(map[string][]int),
-	}, nil
+		Index: make(map[string]*app.PostingList),
+	}
+
+	// New segments are encrypted when a key is loaded, existing ones keep
+	// the format they were started with
+	if seg.Size > 0 {
+		seg.KeyID = segmentKeyID(f.Name())
+	} else if id := activeKey(keys); id != "" {
+		n, err := f.Write(headerLine(id))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		seg.Size, seg.KeyID = int64(n), id
+	}
+	return seg, nil
 }
@@ -0,0 +1,148 @@
+package helper
+
+import (
+	"context"
+	"math/rand"
+	"slices"
+	"testing"
+	"watchlogs/cmd/internal/app"
+)
+
+// intersectSlices is the previous []int based intersection, kept as a
+// baseline for the benchmarks below.
+func intersectSlices(a, b []int) []int {
+	var i = 0
+	var j = 0
+	var result []int
+
+	for i < len(a) && j < len(b) {
+		if a[i] == b[j] {
+			result = append(result, a[i])
+			i++
+			j++
+		} else if a[i] < b[j] {
+			i++
+		} else {
+			j++
+		}
+	}
+	return result
+}
+
+// postingIDs returns n sorted IDs whose gaps are between 1 and maxGap.
+func postingIDs(n, maxGap int, seed int64) []int {
+	r := rand.New(rand.NewSource(seed))
+	ids := make([]int, n)
+	id := 0
+	for i := range ids {
+		id += 1 + r.Intn(maxGap)
+		ids[i] = id
+	}
+	return ids
+}
+
+func TestIntersect(t *testing.T) {
+	a := postingIDs(5000, 4, 1)
+	b := postingIDs(700, 30, 2)
+
+	got := Intersect(app.NewPostingList(a), app.NewPostingList(b)).IDs()
+	want := intersectSlices(a, b)
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected %d common IDs, got %d", len(want), len(got))
+	}
+
+	if n := Intersect(app.NewPostingList(a), nil).Len(); n != 0 {
+		t.Errorf("expected empty intersection with nil list, got %d", n)
+	}
+}
+
+func TestPostingListDropFirst(t *testing.T) {
+	ids := postingIDs(300, 10, 3)
+	p := app.NewPostingList(ids)
+	p.Add(ids[len(ids)-1]) // duplicates are ignored
+
+	for i := range 200 {
+		p.DropFirst()
+		if got := p.IDs(); !slices.Equal(got, ids[i+1:]) {
+			t.Fatalf("after %d drops expected %d IDs, got %d", i+1, len(ids)-i-1, len(got))
+		}
+	}
+}
+
+func TestIndexEntryCapsPostings(t *testing.T) {
+	seg := &app.Segment{Index: make(map[string]*app.PostingList)}
+	for i := range 10 {
+		IndexEntry(seg, i, app.LogEntry{Message: "disk disk full"}, 4)
+	}
+
+	if got := seg.Index["disk"].IDs(); !slices.Equal(got, []int{6, 7, 8, 9}) {
+		t.Errorf("expected newest 4 IDs, got %v", got)
+	}
+}
+
+const benchEntries = 1_000_000
+
+func BenchmarkPostingMemory(b *testing.B) {
+	ids := postingIDs(benchEntries, 8, 1)
+
+	b.Run("slice", func(b *testing.B) {
+		for range b.N {
+			var s []int
+			for _, id := range ids {
+				s = append(s, id)
+			}
+			b.ReportMetric(float64(cap(s)*8), "bytes/1M")
+		}
+	})
+
+	b.Run("compressed", func(b *testing.B) {
+		for range b.N {
+			p := &app.PostingList{}
+			for _, id := range ids {
+				p.Add(id)
+			}
+			b.ReportMetric(float64(p.SizeBytes()), "bytes/1M")
+		}
+	})
+}
+
+func BenchmarkIntersect(b *testing.B) {
+	cases := []struct {
+		name       string
+		small, big []int
+	}{
+		{"similar", postingIDs(benchEntries, 4, 1), postingIDs(benchEntries, 4, 2)},
+		{"skewed", postingIDs(1000, 4000, 3), postingIDs(benchEntries, 4, 4)},
+	}
+
+	for _, c := range cases {
+		pa, pb := app.NewPostingList(c.small), app.NewPostingList(c.big)
+
+		b.Run(c.name+"/slice", func(b *testing.B) {
+			for range b.N {
+				intersectSlices(c.small, c.big)
+			}
+		})
+		b.Run(c.name+"/compressed", func(b *testing.B) {
+			for range b.N {
+				Intersect(pa, pb)
+			}
+		})
+	}
+}
+
+func TestIntersectContextCancelled(t *testing.T) {
+	a := app.NewPostingList(postingIDs(3*intersectCheckEvery, 2, 5))
+	b := app.NewPostingList(postingIDs(3*intersectCheckEvery, 2, 6))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	partial, err := IntersectContext(ctx, a, b)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if full := Intersect(a, b); partial.Len() >= full.Len() {
+		t.Errorf("expected intersection to stop early, got %d of %d", partial.Len(), full.Len())
+	}
+}
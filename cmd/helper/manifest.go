@@ -0,0 +1,263 @@
+package helper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/crypt"
+)
+
+// ManifestFile is the name of the manifest in DataPath.
+const ManifestFile = "manifest.json"
+
+// manifestMu serializes manifest rewrites, which come from the writer,
+// retention, compaction and eviction.
+var manifestMu sync.Mutex
+
+// Manifest records what is known about every segment file in DataPath.
+type Manifest struct {
+	Updated  time.Time     `json:"updated"`
+	Segments []SegmentMeta `json:"segments"`
+}
+
+// SegmentMeta describes one segment file. Checksum is the SHA-256 of the
+// file and is only recorded once the segment is sealed. Remote segments
+// are no longer on local disk but in the blob store.
+type SegmentMeta struct {
+	Id       int       `json:"id"`
+	File     string    `json:"file"`
+	Sealed   bool      `json:"sealed"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	Entries  int       `json:"entries"`
+	MinTime  time.Time `json:"minTime,omitzero"`
+	MaxTime  time.Time `json:"maxTime,omitzero"`
+	Checksum string    `json:"checksum,omitempty"`
+	Remote   bool      `json:"remote,omitempty"` // moved to the blob store
+}
+
+// LoadManifest reads the manifest of dir. A missing manifest is empty.
+func LoadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if os.IsNotExist(err) {
+		return &Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	return &m, nil
+}
+
+// WriteManifest replaces the manifest of dir through a temporary file and
+// a rename, so readers never see a partial manifest.
+func WriteManifest(dir string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".manifest-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, ManifestFile))
+}
+
+// DescribeSegment scans segment id of dir for its metadata.
+func DescribeSegment(dir string, id int, sealed bool, keys *crypt.Keyring) (SegmentMeta, error) {
+	path := SegmentPath(dir, id)
+	meta := SegmentMeta{Id: id, File: filepath.Base(path), Sealed: sealed}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return meta, err
+	}
+	meta.Size, meta.ModTime = info.Size(), info.ModTime()
+
+	hash := sha256.New()
+	scanner := newLineReader(io.TeeReader(f, hash), keys)
+	for scanner.Scan() {
+		var entry app.LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		meta.Entries++
+		if meta.MinTime.IsZero() || entry.Timestamp.Before(meta.MinTime) {
+			meta.MinTime = entry.Timestamp
+		}
+		if entry.Timestamp.After(meta.MaxTime) {
+			meta.MaxTime = entry.Timestamp
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return meta, err
+	}
+	if sealed {
+		meta.Checksum = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	}
+	return meta, nil
+}
+
+// RefreshManifest rewrites the manifest of dir from the segment files on
+// disk. Segments below currentID are sealed. Metadata of sealed segments
+// whose size and modification time are unchanged is reused rather than
+// rescanned.
+func RefreshManifest(dir string, currentID int, keys *crypt.Keyring) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	old, err := LoadManifest(dir)
+	if err != nil {
+		old = &Manifest{}
+	}
+	known := make(map[int]SegmentMeta, len(old.Segments))
+	for _, meta := range old.Segments {
+		known[meta.Id] = meta
+	}
+
+	ids, err := ListSegments(dir)
+	if err != nil {
+		return err
+	}
+	local := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		local[id] = true
+	}
+
+	m := &Manifest{Updated: time.Now(), Segments: []SegmentMeta{}}
+	for _, meta := range old.Segments {
+		if meta.Remote && !local[meta.Id] {
+			m.Segments = append(m.Segments, meta)
+		}
+	}
+	for _, id := range ids {
+		sealed := id < currentID
+		if meta, ok := known[id]; ok && sealed && meta.Sealed {
+			info, err := os.Stat(SegmentPath(dir, id))
+			if err == nil && info.Size() == meta.Size && info.ModTime().Equal(meta.ModTime) {
+				m.Segments = append(m.Segments, meta)
+				continue
+			}
+		}
+		meta, err := DescribeSegment(dir, id, sealed, keys)
+		if err != nil {
+			log.Printf("Failed to describe segment %d for the manifest: %v\n", id, err)
+			continue
+		}
+		m.Segments = append(m.Segments, meta)
+	}
+	sort.Slice(m.Segments, func(i, j int) bool { return m.Segments[i].Id < m.Segments[j].Id })
+	return WriteManifest(dir, m)
+}
+
+// updateManifest applies fn to the manifest of dir and writes it back.
+func updateManifest(dir string, fn func(m *Manifest)) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	m, err := LoadManifest(dir)
+	if err != nil {
+		return err
+	}
+	fn(m)
+	sort.Slice(m.Segments, func(i, j int) bool { return m.Segments[i].Id < m.Segments[j].Id })
+	m.Updated = time.Now()
+	return WriteManifest(dir, m)
+}
+
+// refreshManifest refreshes the manifest of DataPath, logging failures.
+// The caller must not hold App.Mu.
+func refreshManifest(a *app.App) {
+	a.Mu.Lock()
+	currentID := a.CurrentSegment.Id
+	a.Mu.Unlock()
+	if err := RefreshManifest(a.Cfg.DataPath, currentID, a.Keys); err != nil {
+		log.Printf("Failed to update the segment manifest: %v\n", err)
+	}
+}
+
+// ReconcileManifest compares the manifest of dir with the segment files on
+// disk and returns the discrepancies found: segments missing from either
+// side and sealed segments whose size or checksum changed. The manifest is
+// then rebuilt from the files, which are the source of truth.
+func ReconcileManifest(dir string, currentID int, keys *crypt.Keyring) ([]string, error) {
+	m, err := LoadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := ListSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	onDisk := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		onDisk[id] = true
+	}
+	listed := make(map[int]bool, len(m.Segments))
+	for _, meta := range m.Segments {
+		listed[meta.Id] = true
+		if meta.Remote {
+			continue
+		}
+		if !onDisk[meta.Id] {
+			problems = append(problems, fmt.Sprintf("segment %d is in the manifest but missing on disk", meta.Id))
+			continue
+		}
+		if !meta.Sealed {
+			continue
+		}
+		got, err := DescribeSegment(dir, meta.Id, true, keys)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("segment %d cannot be read: %v", meta.Id, err))
+			continue
+		}
+		if got.Size != meta.Size {
+			problems = append(problems, fmt.Sprintf("segment %d is %d bytes, manifest says %d", meta.Id, got.Size, meta.Size))
+		} else if got.Checksum != meta.Checksum {
+			problems = append(problems, fmt.Sprintf("segment %d checksum does not match the manifest", meta.Id))
+		}
+	}
+	// Only files below the last listed one are unexpected, newer ones may
+	// have been created after the last manifest update.
+	for _, id := range ids {
+		if !listed[id] && len(m.Segments) > 0 && id < m.Segments[len(m.Segments)-1].Id {
+			problems = append(problems, fmt.Sprintf("segment %d is on disk but not in the manifest", id))
+		}
+	}
+
+	if err := RefreshManifest(dir, currentID, keys); err != nil {
+		return problems, err
+	}
+	return problems, nil
+}
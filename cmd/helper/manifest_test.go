@@ -0,0 +1,47 @@
+package helper
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"watchlogs/cmd/internal/app"
+)
+
+func TestReconcileManifest(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for id := 1; id <= 3; id++ {
+		writeSegment(t, dir, id, app.LogEntry{Timestamp: now, Message: "entry"})
+	}
+
+	if err := RefreshManifest(dir, 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Segments) != 3 || !m.Segments[0].Sealed || m.Segments[2].Sealed {
+		t.Fatalf("expected segments 1-2 sealed and 3 open, got %+v", m.Segments)
+	}
+	if m.Segments[0].Entries != 1 || m.Segments[0].Checksum == "" || m.Segments[2].Checksum != "" {
+		t.Errorf("unexpected metadata %+v", m.Segments[0])
+	}
+
+	// Lose segment 1 and tamper with segment 2
+	os.Remove(SegmentPath(dir, 1))
+	os.WriteFile(SegmentPath(dir, 2), []byte(`{"message":"other"}`+"\n"), 0644)
+
+	problems, err := ReconcileManifest(dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 || !strings.Contains(problems[0], "segment 1") || !strings.Contains(problems[1], "segment 2") {
+		t.Errorf("expected discrepancies for segments 1 and 2, got %q", problems)
+	}
+
+	if problems, _ := ReconcileManifest(dir, 3, nil); len(problems) != 0 {
+		t.Errorf("expected rebuilt manifest to match disk, got %q", problems)
+	}
+}
@@ -0,0 +1,230 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/crypt"
+	"watchlogs/cmd/internal/patterns"
+)
+
+// mappedEntries holds the entries of a sealed segment in its memory-mapped
+// file. Besides the offset of each entry line it keeps the timestamp and
+// level, so time and level filters run without decoding entries. None of
+// it holds pointers, which keeps it out of the garbage collector's way.
+type mappedEntries struct {
+	data    []byte
+	keys    *crypt.Keyring
+	keyID   string
+	offsets []int64
+	times   []int64 // unix nanoseconds, noTime for a zero timestamp
+	levels  []uint8 // index into names, otherLevel if names is full
+	names   []string
+}
+
+const (
+	noTime     = math.MinInt64
+	otherLevel = math.MaxUint8
+)
+
+func (m *mappedEntries) add(offset int64, entry app.LogEntry) {
+	m.offsets = append(m.offsets, offset)
+
+	t := int64(noTime)
+	if !entry.Timestamp.IsZero() {
+		t = entry.Timestamp.UnixNano()
+	}
+	m.times = append(m.times, t)
+
+	level := uint8(otherLevel)
+	for i, name := range m.names {
+		if name == entry.Level {
+			level = uint8(i)
+			break
+		}
+	}
+	if level == otherLevel && len(m.names) < otherLevel {
+		level = uint8(len(m.names))
+		m.names = append(m.names, entry.Level)
+	}
+	m.levels = append(m.levels, level)
+}
+
+func (m *mappedEntries) Len() int {
+	return len(m.offsets)
+}
+
+func (m *mappedEntries) Entry(id int) app.LogEntry {
+	var entry app.LogEntry
+	if id < 0 || id >= len(m.offsets) {
+		return entry
+	}
+	line := m.data[m.offsets[id]:]
+	if end := bytes.IndexByte(line, '\n'); end >= 0 {
+		line = line[:end]
+	}
+	if data, err := decodeLine(m.keyID, line, m.keys); err == nil {
+		json.Unmarshal(data, &entry)
+	}
+	return entry
+}
+
+func (m *mappedEntries) Time(id int) time.Time {
+	if id < 0 || id >= len(m.times) || m.times[id] == noTime {
+		return time.Time{}
+	}
+	return time.Unix(0, m.times[id])
+}
+
+func (m *mappedEntries) Level(id int) string {
+	if id < 0 || id >= len(m.levels) {
+		return ""
+	}
+	if i := m.levels[id]; int(i) < len(m.names) {
+		return m.names[i]
+	}
+	return m.Entry(id).Level
+}
+
+// Close unmaps the file. The entries are empty afterwards.
+func (m *mappedEntries) Close() error {
+	data := m.data
+	*m = mappedEntries{}
+	return unmapFile(data)
+}
+
+// MapSegment maps the sealed segment file at path and indexes the entries
+// keep accepts into seg, like ReadSegment but without keeping the entries
+// themselves in memory. keep and miner may be nil.
+func MapSegment(seg *app.Segment, path string, keep func(app.LogEntry) bool, miner *patterns.Miner, keys *crypt.Keyring) error {
+	return mapSegment(seg, path, keep, func(entry app.LogEntry) int {
+		return miner.Add(entry.Message)
+	}, 0, keys)
+}
+
+// mapSegment replaces the entries and index of seg with those of the
+// segment file at path that keep accepts, mapping the file, and writes
+// its bloom filter. pattern returns the pattern ID of each accepted entry,
+// in order. If the file cannot be read to the end, the entries read so
+// far are kept.
+func mapSegment(seg *app.Segment, path string, keep func(app.LogEntry) bool, pattern func(app.LogEntry) int, maxPerToken int, keys *crypt.Keyring) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return err
+	}
+
+	m := &mappedEntries{data: data, keys: keys}
+	fresh := &app.Segment{Index: make(map[string]*app.PostingList)}
+	scanner := newLineReader(bytes.NewReader(data), keys)
+	for scanner.Scan() {
+		var entry app.LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if keep != nil && !keep(entry) {
+			continue
+		}
+		id := m.Len()
+		m.add(scanner.Offset(), entry)
+		fresh.Patterns = append(fresh.Patterns, pattern(entry))
+		IndexEntry(fresh, id, entry, maxPerToken)
+	}
+	m.keyID = scanner.keyID
+
+	setMapped(seg, m)
+	seg.Size = info.Size()
+	seg.Index, seg.Fields, seg.Tokens, seg.Patterns = fresh.Index, fresh.Fields, fresh.Tokens, fresh.Patterns
+	seg.MinTime, seg.MaxTime = fresh.MinTime, fresh.MaxTime
+	seg.Bloom = indexBloom(seg)
+	if err := writeBloom(filepath.Dir(path), seg.Id, seg.Bloom, keys); err != nil {
+		log.Printf("Failed to write the bloom filter of segment %d: %v\n", seg.Id, err)
+	}
+	return scanner.Err()
+}
+
+// replayPatterns returns a pattern function for mapSegment handing out the
+// known pattern IDs of a rewritten segment's entries in order.
+func replayPatterns(pats []int) func(app.LogEntry) int {
+	next := 0
+	return func(app.LogEntry) int {
+		if next >= len(pats) {
+			return 0
+		}
+		next++
+		return pats[next-1]
+	}
+}
+
+// sealSegment maps the file of seg once it is sealed and drops its
+// entries from memory. The index is kept, since entry IDs do not change.
+func sealSegment(seg *app.Segment, dir string, keys *crypt.Keyring) error {
+	if seg.Mapped != nil {
+		return nil
+	}
+	if len(seg.Offsets) != len(seg.Logs) {
+		return fmt.Errorf("have %d offsets for %d entries", len(seg.Offsets), len(seg.Logs))
+	}
+	f, err := os.Open(SegmentPath(dir, seg.Id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := mapFile(f, int(seg.Size))
+	if err != nil {
+		return err
+	}
+
+	m := &mappedEntries{data: data, keys: keys, keyID: seg.KeyID}
+	for i, entry := range seg.Logs {
+		m.add(seg.Offsets[i], entry)
+	}
+	setMapped(seg, m)
+	return nil
+}
+
+// lineOffsets returns the offsets of the entry lines of the segment file
+// at path.
+func lineOffsets(path string, keys *crypt.Keyring) ([]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var offsets []int64
+	scanner := newLineReader(f, keys)
+	for scanner.Scan() {
+		offsets = append(offsets, scanner.Offset())
+	}
+	return offsets, scanner.Err()
+}
+
+// setMapped makes m the entries of seg, unmapping any it had before.
+func setMapped(seg *app.Segment, m app.Entries) {
+	if seg.Mapped != nil {
+		seg.Mapped.Close()
+	}
+	seg.Mapped = m
+	seg.Logs, seg.Offsets = nil, nil
+}
+
+// releaseSegment unmaps a segment removed from App.Segments once no reader
+// holds it any more, see Segment.Hold. The caller must hold App.Mu.
+func releaseSegment(seg *app.Segment) {
+	seg.Retire()
+}
@@ -0,0 +1,148 @@
+package helper
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"testing"
+	"time"
+	"watchlogs/cmd/internal/app"
+)
+
+func TestSealSegment(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Second)
+
+	seg, err := OpenSegment(1, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := json.Marshal(app.LogEntry{Timestamp: now, Level: "info", Message: "user login"})
+	a := &app.App{
+		Cfg:            app.Config{DataPath: dir, MaxSegSize: int64(2*len(first) + 1)},
+		CurrentSegment: seg,
+		Segments:       []*app.Segment{seg},
+	}
+	for i, e := range []app.LogEntry{
+		{Timestamp: now, Level: "info", Message: "user login"},
+		{Timestamp: now.Add(time.Second), Level: "error", Message: "payment failed", Fields: map[string]string{"service": "billing"}},
+	} {
+		data, _ := json.Marshal(e)
+		if err := commit(a, e, data); err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+	}
+	defer a.CurrentSegment.File.Close()
+
+	if a.CurrentSegment == seg || seg.Mapped == nil || seg.Logs != nil {
+		t.Fatal("expected the rotated segment to be mapped instead of kept in memory")
+	}
+	if seg.Len() != 2 || seg.Level(1) != "error" || !seg.Time(1).Equal(now.Add(time.Second)) {
+		t.Errorf("expected time and level of mapped entries, got %d entries, %q at %v", seg.Len(), seg.Level(1), seg.Time(1))
+	}
+	if e := seg.Entry(1); e.Message != "payment failed" || e.Fields["service"] != "billing" {
+		t.Errorf("expected entry decoded from the file, got %+v", e)
+	}
+	if ids := seg.Index["payment"].IDs(); !slices.Equal(ids, []int{1}) {
+		t.Errorf("expected index kept after sealing, got %v", ids)
+	}
+
+	if seg.Bloom == nil || !seg.Bloom.Test("payment") {
+		t.Error("expected bloom filter built on sealing")
+	}
+	// The sidecar is written in the background, before the manifest
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if m, err := LoadManifest(dir); err == nil && len(m.Segments) > 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("expected manifest written after rotation")
+		}
+	}
+	if _, err := os.Stat(BloomPath(dir, 1)); err != nil {
+		t.Errorf("expected bloom filter sidecar written after rotation: %v", err)
+	}
+
+	releaseSegment(seg)
+	if seg.Len() != 0 || seg.Entry(1).Message != "" {
+		t.Error("expected released segment to be empty")
+	}
+}
+
+func TestSealSegmentRewrittenBeforeBloom(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Second)
+
+	seg, err := OpenSegment(1, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := app.LogEntry{Timestamp: now, Level: "info", Message: "user login"}
+	data, _ := json.Marshal(e)
+	a := &app.App{
+		Cfg:            app.Config{DataPath: dir, MaxSegSize: int64(len(data))},
+		CurrentSegment: seg,
+		Segments:       []*app.Segment{seg},
+	}
+
+	// Retention rewrites the sealed file before its filter is written
+	a.StorageMu.Lock()
+	if err := commit(a, e, data); err != nil {
+		t.Fatal(err)
+	}
+	defer a.CurrentSegment.File.Close()
+	if _, _, err := rewriteSegment(SegmentPath(dir, 1), func(app.LogEntry) bool { return false }, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.StorageMu.Unlock()
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if m, err := LoadManifest(dir); err == nil && len(m.Segments) > 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("expected manifest written after rotation")
+		}
+	}
+	if _, err := os.Stat(BloomPath(dir, 1)); !os.IsNotExist(err) {
+		t.Errorf("expected no stale bloom filter written over the rewritten segment, got %v", err)
+	}
+	releaseSegment(seg)
+}
+
+func TestMapSegment(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeSegment(t, dir, 1,
+		app.LogEntry{Timestamp: now.Add(-48 * time.Hour), Level: "info", Message: "expired entry"},
+		app.LogEntry{Timestamp: now, Level: "warn", Message: "disk almost full"},
+	)
+	f, _ := os.OpenFile(SegmentPath(dir, 1), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"timestamp":"torn`)
+	f.Close()
+
+	cfg := app.Config{Retention: 24 * time.Hour}
+	seg := &app.Segment{Id: 1}
+	if err := MapSegment(seg, SegmentPath(dir, 1), Retained(cfg, now), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer releaseSegment(seg)
+
+	if seg.Len() != 1 || seg.Entry(0).Message != "disk almost full" || seg.Level(0) != "warn" {
+		t.Fatalf("expected only the retained entry mapped, got %d entries", seg.Len())
+	}
+	if seg.Index["expired"] != nil || seg.Index["disk"].Len() != 1 {
+		t.Error("expected only the retained entry indexed")
+	}
+
+	// Retention remaps the rewritten file
+	cfg.Retention = time.Hour
+	path := SegmentPath(dir, 1)
+	if _, _, err := rewriteSegment(path, Retained(cfg, now.Add(2*time.Hour)), true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := reindexSegment(seg, path, Retained(cfg, now.Add(2*time.Hour)), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if seg.Len() != 0 || seg.Index["disk"] != nil {
+		t.Errorf("expected no entries left after retention, got %d", seg.Len())
+	}
+}
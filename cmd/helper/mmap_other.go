@@ -0,0 +1,23 @@
+//go:build !unix
+
+package helper
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of f, since memory mapping is not
+// implemented on this platform.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// unmapFile releases data returned by mapFile.
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,564 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"watchlogs/cmd/internal/app"
+)
+
+// Query node operators.
+const (
+	OpAnd    = "and"
+	OpOr     = "or"
+	OpNot    = "not"
+	OpTerm   = "term"
+	OpPhrase = "phrase"
+	OpField  = "field"
+)
+
+// Node is one element of a parsed query. Term and phrase nodes carry the
+// normalised tokens they look up in the index; field nodes compare the
+// level, pattern ID or a structured field of each entry. A field node for a
+// structured field carries the tokens of its text as well: an entry
+// without the field matches when its message holds those words, so words
+// such as http://host or user:alice still match as text.
+type Node struct {
+	Op       string   `json:"op"`
+	Text     string   `json:"text,omitempty"`
+	Tokens   []string `json:"tokens,omitempty"`
+	Field    string   `json:"field,omitempty"`
+	Value    string   `json:"value,omitempty"`
+	Children []*Node  `json:"children,omitempty"`
+}
+
+// Query is a parsed search expression. Words are ANDed by default, e.g.
+//
+//	level:error payment ("db timeout" OR deadlock) NOT retry
+//
+// A nil Query matches every entry.
+type Query struct {
+	Root *Node
+}
+
+// ParseQuery parses the /search query language: words, "quoted phrases",
+// field:value filters, AND, OR, NOT (or a leading -) and parentheses.
+func ParseQuery(input string) (*Query, error) {
+	p := &queryParser{items: lexQuery(input)}
+	if len(p.items) == 0 {
+		return nil, nil
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.items) {
+		return nil, fmt.Errorf("unexpected %q in query", p.items[p.pos].text)
+	}
+	if root == nil {
+		return nil, nil // Only words without tokens, e.g. numbers
+	}
+	return &Query{Root: root}, nil
+}
+
+// Tokens returns the tokens of every term and phrase that is not negated,
+// used for ranking and highlighting.
+func (q *Query) Tokens() []string {
+	var tokens []string
+	if q == nil {
+		return tokens
+	}
+
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		switch n.Op {
+		case OpTerm, OpPhrase:
+			for _, t := range n.Tokens {
+				if !slices.Contains(tokens, t) {
+					tokens = append(tokens, t)
+				}
+			}
+		case OpAnd, OpOr:
+			for _, c := range n.Children {
+				walk(c)
+			}
+		}
+	}
+	walk(q.Root)
+	return tokens
+}
+
+type queryItem struct {
+	text   string
+	quoted bool
+}
+
+// lexQuery splits input on whitespace, keeping quoted phrases and
+// parentheses as separate items.
+func lexQuery(input string) []queryItem {
+	var items []queryItem
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			items = append(items, queryItem{text: cur.String()})
+			cur.Reset()
+		}
+	}
+
+	runes := []rune(input)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '"':
+			flush()
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			items = append(items, queryItem{text: string(runes[i+1 : min(end, len(runes))]), quoted: true})
+			i = end
+		case c == '(' || c == ')':
+			flush()
+			items = append(items, queryItem{text: string(c)})
+		case unicode.IsSpace(c):
+			flush()
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	flush()
+	return items
+}
+
+type queryParser struct {
+	items []queryItem
+	pos   int
+}
+
+func (p *queryParser) peek(text string) bool {
+	return p.pos < len(p.items) && !p.items[p.pos].quoted && p.items[p.pos].text == text
+}
+
+func (p *queryParser) parseOr() (*Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	var children []*Node
+	if left != nil {
+		children = append(children, left)
+	}
+	for p.peek("OR") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if right != nil {
+			children = append(children, right)
+		}
+	}
+	switch len(children) {
+	case 0:
+		return nil, nil
+	case 1:
+		return children[0], nil
+	}
+	return &Node{Op: OpOr, Children: children}, nil
+}
+
+func (p *queryParser) parseAnd() (*Node, error) {
+	var children []*Node
+	for p.pos < len(p.items) && !p.peek("OR") && !p.peek(")") {
+		if p.peek("AND") {
+			p.pos++
+			continue
+		}
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		// Words the tokenizer drops entirely are ignored, as at index time
+		if (n.Op == OpTerm || n.Op == OpPhrase) && len(n.Tokens) == 0 {
+			continue
+		}
+		children = append(children, n)
+	}
+	switch len(children) {
+	case 0:
+		return nil, nil
+	case 1:
+		return children[0], nil
+	}
+	return &Node{Op: OpAnd, Children: children}, nil
+}
+
+func (p *queryParser) parseUnary() (*Node, error) {
+	if p.peek("NOT") {
+		p.pos++
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if (n.Op == OpTerm || n.Op == OpPhrase) && len(n.Tokens) == 0 {
+			return nil, fmt.Errorf("nothing to negate after NOT")
+		}
+		return &Node{Op: OpNot, Children: []*Node{n}}, nil
+	}
+
+	if p.pos >= len(p.items) {
+		return nil, fmt.Errorf("expected a search term")
+	}
+	item := p.items[p.pos]
+	if item.quoted {
+		p.pos++
+		return &Node{Op: OpPhrase, Text: item.text, Tokens: Tokenize(item.text)}, nil
+	}
+
+	if item.text == "(" {
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		if n == nil {
+			return nil, fmt.Errorf("empty parentheses")
+		}
+		return n, nil
+	}
+	if item.text == ")" {
+		return nil, fmt.Errorf("unexpected closing parenthesis")
+	}
+
+	p.pos++
+	if len(item.text) > 1 && item.text[0] == '-' {
+		inner := &queryParser{items: []queryItem{{text: "NOT"}, {text: item.text[1:]}}}
+		return inner.parseUnary()
+	}
+	if field, value, ok := strings.Cut(item.text, ":"); ok && isFieldName(field) && value != "" {
+		if builtinField(field) {
+			return &Node{Op: OpField, Field: field, Value: value}, nil
+		}
+		return &Node{Op: OpField, Text: item.text, Tokens: Tokenize(item.text), Field: field, Value: value}, nil
+	}
+	return &Node{Op: OpTerm, Text: item.text, Tokens: Tokenize(item.text)}, nil
+}
+
+// builtinField reports whether field is one every entry has rather than
+// a structured field.
+func builtinField(field string) bool {
+	return field == "level" || field == "pattern"
+}
+
+// filtersOn reports whether field node n has to be checked entry by entry
+// in a segment holding the structured fields in fields. Where no entry has
+// the field every entry matches on its text, which the index answers.
+func filtersOn(n *Node, fields map[string]bool) bool {
+	return builtinField(n.Field) || fields[n.Field]
+}
+
+func isFieldName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// MayMatch reports whether a segment holding just the tokens in set could
+// have entries satisfying the query. Only terms and phrases are checked;
+// field filters and negations are assumed to match.
+func (q *Query) MayMatch(set TokenSet) bool {
+	if q == nil {
+		return true
+	}
+	return mayMatch(q.Root, set)
+}
+
+func mayMatch(n *Node, set TokenSet) bool {
+	switch n.Op {
+	case OpTerm, OpPhrase:
+		for _, t := range n.Tokens {
+			if !set.Test(t) {
+				return false
+			}
+		}
+	case OpAnd:
+		for _, c := range n.Children {
+			if !mayMatch(c, set) {
+				return false
+			}
+		}
+	case OpOr:
+		for _, c := range n.Children {
+			if mayMatch(c, set) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// MatchEntry reports whether entry satisfies the query, checking the
+// tokens of its message directly rather than a segment index. It agrees
+// with Match on any segment holding entry, except that pattern filters
+// never match, since a lone entry has no pattern ID.
+func (q *Query) MatchEntry(entry app.LogEntry) bool {
+	if q == nil {
+		return true
+	}
+	return matchEntry(q.Root, entry, Tokenize(entry.Message))
+}
+
+func matchEntry(n *Node, entry app.LogEntry, tokens []string) bool {
+	switch n.Op {
+	case OpTerm:
+		for _, t := range n.Tokens {
+			if !slices.Contains(tokens, t) {
+				return false
+			}
+		}
+		return true
+	case OpPhrase:
+		return containsPhrase(tokens, n.Tokens)
+	case OpField:
+		switch n.Field {
+		case "level":
+			return strings.EqualFold(entry.Level, n.Value)
+		case "pattern":
+			return false
+		}
+		return matchField(n, entry, tokens)
+	case OpNot:
+		return !matchEntry(n.Children[0], entry, tokens)
+	case OpOr:
+		for _, c := range n.Children {
+			if matchEntry(c, entry, tokens) {
+				return true
+			}
+		}
+		return false
+	case OpAnd:
+		for _, c := range n.Children {
+			if !matchEntry(c, entry, tokens) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// MatchStats records the work done to evaluate a query on one segment.
+type MatchStats struct {
+	Postings      map[string]int `json:"postings"`      // posting list size per token looked up
+	IntersectCost int            `json:"intersectCost"` // IDs visited by intersections
+	Scanned       int            `json:"scanned"`       // entries checked one by one
+}
+
+// Match returns the IDs of the entries of seg that satisfy the query. If
+// ctx ends the evaluation part way no IDs are returned, since a cut short
+// operand would make NOT match entries it excludes. stats may be nil.
+func (q *Query) Match(ctx context.Context, seg *app.Segment, stats *MatchStats) *app.PostingList {
+	if q == nil {
+		return allIDs(seg)
+	}
+	e := &evaluator{ctx: ctx, seg: seg, stats: stats}
+	return e.eval(q.Root)
+}
+
+type evaluator struct {
+	ctx   context.Context
+	seg   *app.Segment
+	stats *MatchStats
+	err   error // set once ctx ended an intersection
+}
+
+// eval evaluates n, returning no IDs once an intersection was cut short.
+func (e *evaluator) eval(n *Node) *app.PostingList {
+	if e.err != nil {
+		return &app.PostingList{}
+	}
+	ids := e.evalNode(n)
+	if e.err != nil {
+		return &app.PostingList{}
+	}
+	return ids
+}
+
+func (e *evaluator) evalNode(n *Node) *app.PostingList {
+	switch n.Op {
+	case OpTerm:
+		return e.lookup(n.Tokens)
+
+	case OpPhrase:
+		ids := e.lookup(n.Tokens)
+		if len(n.Tokens) < 2 {
+			return ids
+		}
+		return e.filter(ids, func(id int) bool {
+			return containsPhrase(Tokenize(e.seg.Entry(id).Message), n.Tokens)
+		})
+
+	case OpField:
+		if !filtersOn(n, e.seg.Fields) {
+			return e.lookup(n.Tokens)
+		}
+		return e.filter(allIDs(e.seg), func(id int) bool {
+			return e.fieldMatch(n, id)
+		})
+
+	case OpNot:
+		return Difference(allIDs(e.seg), e.eval(n.Children[0]))
+
+	case OpOr:
+		var ids *app.PostingList
+		for _, c := range n.Children {
+			ids = Union(ids, e.eval(c))
+		}
+		return ids
+
+	case OpAnd:
+		// Intersect the index backed children first, then check field
+		// filters only on the remaining candidates.
+		var ids *app.PostingList
+		var fields []*Node
+		for _, c := range n.Children {
+			if c.Op == OpField && filtersOn(c, e.seg.Fields) {
+				fields = append(fields, c)
+				continue
+			}
+			ids = e.intersect(ids, e.eval(c))
+			if ids.Len() == 0 {
+				return ids
+			}
+		}
+		if ids == nil {
+			ids = allIDs(e.seg)
+		}
+		if len(fields) > 0 {
+			ids = e.filter(ids, func(id int) bool {
+				for _, f := range fields {
+					if !e.fieldMatch(f, id) {
+						return false
+					}
+				}
+				return true
+			})
+		}
+		return ids
+	}
+	return &app.PostingList{}
+}
+
+// lookup intersects the posting lists of tokens. A term without any
+// tokens, such as a number, matches every entry.
+func (e *evaluator) lookup(tokens []string) *app.PostingList {
+	if len(tokens) == 0 {
+		return allIDs(e.seg)
+	}
+	var ids *app.PostingList
+	for _, t := range tokens {
+		if e.err != nil {
+			return &app.PostingList{}
+		}
+		list := e.seg.Index[t]
+		if e.stats != nil {
+			e.stats.Postings[t] = list.Len()
+		}
+		if list == nil {
+			list = &app.PostingList{}
+		}
+		ids = e.intersect(ids, list)
+	}
+	return ids
+}
+
+// intersect returns the IDs in both a and b. If ctx ends the intersection
+// part way nothing is returned, rather than IDs not checked against every
+// operand.
+func (e *evaluator) intersect(a, b *app.PostingList) *app.PostingList {
+	if a == nil {
+		return b
+	}
+	if e.stats != nil {
+		e.stats.IntersectCost += a.Len() + b.Len()
+	}
+	ids, err := IntersectContext(e.ctx, a, b)
+	if err != nil {
+		e.err = err
+		return &app.PostingList{}
+	}
+	return ids
+}
+
+func (e *evaluator) filter(ids *app.PostingList, keep func(id int) bool) *app.PostingList {
+	result := &app.PostingList{}
+	it := ids.Iterator()
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		if e.stats != nil {
+			e.stats.Scanned++
+		}
+		if keep(id) {
+			result.Add(id)
+		}
+	}
+	return result
+}
+
+func (e *evaluator) fieldMatch(n *Node, id int) bool {
+	switch n.Field {
+	case "level":
+		return strings.EqualFold(e.seg.Level(id), n.Value)
+	case "pattern":
+		p, err := strconv.Atoi(n.Value)
+		return err == nil && id < len(e.seg.Patterns) && e.seg.Patterns[id] == p
+	}
+	entry := e.seg.Entry(id)
+	return matchField(n, entry, Tokenize(entry.Message))
+}
+
+// matchField reports whether entry, whose message has tokens, satisfies
+// field node n for a structured field: either the field equals the value,
+// or the entry lacks the field and its message holds the words of n.
+func matchField(n *Node, entry app.LogEntry, tokens []string) bool {
+	if v, ok := entry.Fields[n.Field]; ok {
+		return strings.EqualFold(v, n.Value)
+	}
+	for _, t := range n.Tokens {
+		if !slices.Contains(tokens, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsPhrase(tokens, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		if slices.Equal(tokens[i:i+len(phrase)], phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+func allIDs(seg *app.Segment) *app.PostingList {
+	ids := &app.PostingList{}
+	for id := range seg.Len() {
+		ids.Add(id)
+	}
+	return ids
+}
@@ -0,0 +1,214 @@
+package helper
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"watchlogs/cmd/internal/app"
+)
+
+func TestParseQuery(t *testing.T) {
+	q, err := ParseQuery(`level:error Payment ("db timeout" OR deadlock) -retry`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	root := q.Root
+	if root.Op != OpAnd || len(root.Children) != 4 {
+		t.Fatalf("expected and of 4 children, got %+v", root)
+	}
+	if c := root.Children[0]; c.Op != OpField || c.Field != "level" || c.Value != "error" {
+		t.Errorf("expected level field, got %+v", c)
+	}
+	if c := root.Children[2]; c.Op != OpOr || c.Children[0].Op != OpPhrase {
+		t.Errorf("expected or with phrase, got %+v", c)
+	}
+	if c := root.Children[3]; c.Op != OpNot || c.Children[0].Tokens[0] != "retry" {
+		t.Errorf("expected negated retry, got %+v", c)
+	}
+	if want := []string{"payment", "db", "timeout", "deadlock"}; !slices.Equal(q.Tokens(), want) {
+		t.Errorf("expected tokens %v, got %v", want, q.Tokens())
+	}
+
+	for _, bad := range []string{"(payment", "payment )", "NOT", "()"} {
+		if _, err := ParseQuery(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+	if q, err := ParseQuery("500 !!"); q != nil || err != nil {
+		t.Errorf("expected empty query for words without tokens, got %v, %v", q, err)
+	}
+}
+
+func TestQueryMatch(t *testing.T) {
+	seg := &app.Segment{Index: make(map[string]*app.PostingList)}
+	for i, e := range []app.LogEntry{
+		{Level: "ERROR", Message: "db timeout on payment"},
+		{Level: "INFO", Message: "timeout db reconnect"},
+		{Level: "ERROR", Message: "payment deadlock retry"},
+		{Level: "error", Message: "payment declined", Fields: map[string]string{"region": "eu"}},
+	} {
+		seg.Logs = append(seg.Logs, e)
+		IndexEntry(seg, i, e, 0)
+	}
+
+	cases := map[string][]int{
+		`"db timeout"`:                          {0},
+		`db timeout`:                            {0, 1},
+		`level:error payment`:                   {0, 2, 3},
+		`payment ("db timeout" OR deadlock)`:    {0, 2},
+		`payment -retry`:                        {0, 3},
+		`NOT payment`:                           {1},
+		`region:EU OR reconnect`:                {1, 3},
+		`level:error AND (declined OR timeout)`: {0, 3},
+	}
+	for input, want := range cases {
+		q, err := ParseQuery(input)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", input, err)
+		}
+		stats := &MatchStats{Postings: make(map[string]int)}
+		if got := q.Match(context.Background(), seg, stats).IDs(); !slices.Equal(got, want) {
+			t.Errorf("%q: expected %v, got %v", input, want, got)
+		}
+
+		// Matching entries one by one agrees with the index
+		var got []int
+		for id, e := range seg.Logs {
+			if q.MatchEntry(e) {
+				got = append(got, id)
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%q: expected entries %v to match on their own, got %v", input, want, got)
+		}
+	}
+}
+
+func TestQueryMatchFieldLikeWords(t *testing.T) {
+	seg := &app.Segment{Index: make(map[string]*app.PostingList)}
+	for i, e := range []app.LogEntry{
+		{Level: "ERROR", Message: "fetch http://host/api failed"},
+		{Level: "INFO", Message: "user:alice logged in"},
+		{Level: "INFO", Message: "host restarted", Fields: map[string]string{"region": "eu"}},
+	} {
+		seg.Logs = append(seg.Logs, e)
+		IndexEntry(seg, i, e, 0)
+	}
+
+	// No entry has an http or user field, so these are searched as text
+	cases := map[string][]int{
+		`http://host`:             {0},
+		`user:alice`:              {1},
+		`level:error http://host`: {0},
+		`region:eu host`:          {2},
+		`NOT user:alice`:          {0, 2},
+	}
+	for input, want := range cases {
+		q, err := ParseQuery(input)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", input, err)
+		}
+		if got := q.Match(context.Background(), seg, nil).IDs(); !slices.Equal(got, want) {
+			t.Errorf("%q: expected %v, got %v", input, want, got)
+		}
+		for id, e := range seg.Logs {
+			if q.MatchEntry(e) != slices.Contains(want, id) {
+				t.Errorf("%q: expected entry %d to match on its own as in the index", input, id)
+			}
+		}
+	}
+
+	// An entry carrying the field is matched on its value, the others
+	// still on their text
+	e := app.LogEntry{Message: "login", Fields: map[string]string{"user": "alice"}}
+	seg.Logs = append(seg.Logs, e)
+	IndexEntry(seg, 3, e, 0)
+	q, _ := ParseQuery("user:alice")
+	if got := q.Match(context.Background(), seg, nil).IDs(); !slices.Equal(got, []int{1, 3}) {
+		t.Errorf("expected user:alice to match on the field or the text, got %v", got)
+	}
+}
+
+func TestQueryMatchAgreesWithMatchEntry(t *testing.T) {
+	// Some entries carry the user field and some only mention it
+	entries := []app.LogEntry{
+		{Level: "INFO", Message: "user:alice logged in"},
+		{Level: "INFO", Message: "login ok", Fields: map[string]string{"user": "alice"}},
+		{Level: "WARN", Message: "user:alice locked out", Fields: map[string]string{"user": "bob"}},
+		{Level: "ERROR", Message: "login failed", Fields: map[string]string{"user": "Bob", "region": "eu"}},
+		{Level: "INFO", Message: "disk full", Fields: map[string]string{"region": "us"}},
+	}
+	inputs := []string{
+		"user:alice",
+		"user:bob",
+		"NOT user:alice",
+		"user:alice OR region:eu",
+		"login user:bob",
+		"level:info user:alice",
+		"region:us OR user:alice",
+		`"logged in" user:alice`,
+		"NOT (user:bob OR region:us)",
+	}
+	check := func(seg *app.Segment, entries []app.LogEntry) {
+		t.Helper()
+		for _, input := range inputs {
+			q, err := ParseQuery(input)
+			if err != nil {
+				t.Fatalf("%q: unexpected error: %v", input, err)
+			}
+			got := q.Match(context.Background(), seg, nil).IDs()
+			var want []int
+			for id, e := range entries {
+				if q.MatchEntry(e) {
+					want = append(want, id)
+				}
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("%q: index matched %v, entries on their own %v", input, got, want)
+			}
+		}
+	}
+
+	// The same entries give the same answers in a segment of their own,
+	// whichever of their fields the other entries of the segment have
+	for i := range entries {
+		seg := &app.Segment{Index: make(map[string]*app.PostingList)}
+		for id, e := range entries[i:] {
+			seg.Logs = append(seg.Logs, e)
+			IndexEntry(seg, id, e, 0)
+		}
+		check(seg, entries[i:])
+	}
+	seg := &app.Segment{Index: make(map[string]*app.PostingList)}
+	seg.Logs = append(seg.Logs, entries[0])
+	IndexEntry(seg, 0, entries[0], 0)
+	check(seg, entries[:1])
+}
+
+func TestQueryMatchTimeout(t *testing.T) {
+	seg := &app.Segment{Index: make(map[string]*app.PostingList)}
+	for i := range 2 * intersectCheckEvery {
+		e := app.LogEntry{Message: "db timeout"}
+		if i%2 == 0 {
+			e.Message += " payment"
+		}
+		seg.Logs = append(seg.Logs, e)
+		IndexEntry(seg, i, e, 0)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The intersection is cut short, so no ID has been checked against
+	// every term
+	q, _ := ParseQuery("db timeout payment")
+	if ids := q.Match(ctx, seg, nil).IDs(); len(ids) != 0 {
+		t.Errorf("expected no IDs from a timed out intersection, got %d", len(ids))
+	}
+
+	// Nor does a negation of one
+	q, _ = ParseQuery("NOT (db timeout payment)")
+	if ids := q.Match(ctx, seg, nil).IDs(); len(ids) != 0 {
+		t.Errorf("expected no IDs from a negated timed out intersection, got %d", len(ids))
+	}
+}
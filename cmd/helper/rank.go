@@ -0,0 +1,44 @@
+package helper
+
+import (
+	"math"
+	"watchlogs/cmd/internal/app"
+)
+
+// BM25 tuning parameters, using the usual defaults.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// BM25 scores entry against the query tokens using the term and document
+// statistics of the segment it was read from.
+func BM25(seg *app.Segment, tokens []string, entry app.LogEntry) float64 {
+	docs := seg.Len()
+	if docs == 0 {
+		return 0
+	}
+	avgLen := float64(seg.Tokens) / float64(docs)
+	if avgLen == 0 {
+		return 0
+	}
+
+	terms := Tokenize(entry.Message)
+	freq := make(map[string]int, len(terms))
+	for _, t := range terms {
+		freq[t]++
+	}
+
+	score := 0.0
+	for _, t := range tokens {
+		tf := float64(freq[t])
+		if tf == 0 {
+			continue
+		}
+		df := float64(seg.Index[t].Len())
+		idf := math.Log(1 + (float64(docs)-df+0.5)/(df+0.5))
+		norm := bm25K1 * (1 - bm25B + bm25B*float64(len(terms))/avgLen)
+		score += idf * tf * (bm25K1 + 1) / (tf + norm)
+	}
+	return score
+}
@@ -0,0 +1,323 @@
+package helper
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/crypt"
+)
+
+// ParseRetentionRules parses a comma separated list of field:value=duration
+// rules, e.g. "level:error=168h,level:debug=6h,service:billing=720h".
+func ParseRetentionRules(v string) ([]app.RetentionRule, error) {
+	var rules []app.RetentionRule
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		match, keep, ok := strings.Cut(part, "=")
+		field, value, ok2 := strings.Cut(match, ":")
+		if !ok || !ok2 || !isFieldName(field) || value == "" {
+			return nil, fmt.Errorf("invalid retention rule %q: want field:value=duration", part)
+		}
+		d, err := time.ParseDuration(keep)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention rule %q: %v", part, err)
+		}
+		rules = append(rules, app.RetentionRule{Field: field, Value: value, Keep: d})
+	}
+	return rules, nil
+}
+
+// RetentionFor returns how long entry is kept: the duration of the first
+// matching rule, or Retention when none matches.
+func RetentionFor(cfg app.Config, entry app.LogEntry) time.Duration {
+	for _, r := range cfg.RetentionRules {
+		v := entry.Fields[r.Field]
+		if r.Field == "level" {
+			v = entry.Level
+		}
+		if strings.EqualFold(v, r.Value) {
+			return r.Keep
+		}
+	}
+	return cfg.Retention
+}
+
+// Retained returns a function reporting whether an entry is still within
+// its retention at now. A retention of zero or less keeps entries forever.
+func Retained(cfg app.Config, now time.Time) func(app.LogEntry) bool {
+	return func(entry app.LogEntry) bool {
+		keep := RetentionFor(cfg, entry)
+		return keep <= 0 || entry.Timestamp.After(now.Add(-keep))
+	}
+}
+
+// retentionBounds returns the shortest and longest retention in cfg. Zero
+// means no entry expires, or, for longest, that some entries never do.
+func retentionBounds(cfg app.Config) (shortest, longest time.Duration) {
+	forever := false
+	for _, keep := range append([]time.Duration{cfg.Retention}, ruleDurations(cfg.RetentionRules)...) {
+		if keep <= 0 {
+			forever = true
+			continue
+		}
+		if shortest == 0 || keep < shortest {
+			shortest = keep
+		}
+		longest = max(longest, keep)
+	}
+	if forever {
+		longest = 0
+	}
+	return shortest, longest
+}
+
+func ruleDurations(rules []app.RetentionRule) []time.Duration {
+	var ds []time.Duration
+	for _, r := range rules {
+		ds = append(ds, r.Keep)
+	}
+	return ds
+}
+
+// ApplyRetention drops the entries of every segment in DataPath that are
+// past their retention. Segments holding only expired entries are
+// removed, segments mixing expired and live entries are rewritten and, when
+// in memory, re-indexed. Segments older than the in-memory ones are
+// rewritten without holding App.Mu.
+func ApplyRetention(a *app.App, now time.Time) {
+	shortest, longest := retentionBounds(a.Cfg)
+	if shortest == 0 {
+		return
+	}
+	keep := Retained(a.Cfg, now)
+	a.StorageMu.Lock()
+	defer a.StorageMu.Unlock()
+
+	ids, err := ListSegments(a.Cfg.DataPath)
+	if err != nil {
+		log.Printf("Failed to list segments for retention: %v\n", err)
+		return
+	}
+	defer refreshManifest(a)
+
+	a.Mu.Lock()
+	firstHot := -1
+	if len(a.Segments) > 0 {
+		firstHot = a.Segments[0].Id
+	}
+	a.Mu.Unlock()
+
+	for _, id := range ids {
+		if firstHot >= 0 && id >= firstHot {
+			break
+		}
+		path := SegmentPath(a.Cfg.DataPath, id)
+		if !expiresBefore(path, now, shortest, longest, a.Keys) {
+			continue
+		}
+		kept, dropped, err := rewriteSegment(path, keep, false, a.Keys)
+		if err != nil {
+			log.Printf("Failed to apply retention to segment %d: %v\n", id, err)
+			continue
+		}
+		if dropped == 0 {
+			continue
+		}
+		log.Printf("Retention dropped %d entries from segment %d, %d left\n", dropped, id, kept)
+		if kept == 0 {
+			removeSidecars(a.Cfg.DataPath, id)
+		} else if err := buildBloom(a.Cfg.DataPath, id, a.Keys); err != nil {
+			log.Printf("Failed to rebuild the bloom filter of segment %d: %v\n", id, err)
+		}
+	}
+
+	a.Mu.Lock()
+	defer a.Mu.Unlock()
+
+	var keptSegments []*app.Segment
+	for _, segment := range a.Segments {
+		path := SegmentPath(a.Cfg.DataPath, segment.Id)
+		current := segment == a.CurrentSegment
+		if !expiresBefore(path, now, shortest, longest, a.Keys) {
+			keptSegments = append(keptSegments, segment)
+			continue
+		}
+
+		if current {
+			segment.File.Sync()
+		}
+		kept, dropped, err := rewriteSegment(path, keep, current, a.Keys)
+		if err != nil {
+			log.Printf("Failed to apply retention to segment %d: %v\n", segment.Id, err)
+			keptSegments = append(keptSegments, segment)
+			continue
+		}
+		if dropped == 0 {
+			keptSegments = append(keptSegments, segment)
+			continue
+		}
+		log.Printf("Retention dropped %d entries from segment %d, %d left\n", dropped, segment.Id, kept)
+
+		if current {
+			// The rewritten file replaced the one the writer appends to
+			segment.File.Close()
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+			if err != nil {
+				log.Printf("Failed to reopen segment %d after retention: %v\n", segment.Id, err)
+			} else {
+				segment.File = f
+				segment.KeyID = segmentKeyID(path)
+			}
+		}
+		if kept == 0 && !current {
+			releaseSegment(segment)
+			removeSidecars(a.Cfg.DataPath, segment.Id)
+			continue
+		}
+
+		if info, err := os.Stat(path); err == nil {
+			segment.Size = info.Size()
+		}
+		if err := reindexSegment(segment, path, keep, a.Cfg.MaxPerToken, a.Keys); err != nil {
+			log.Printf("Failed to reindex segment %d after retention: %v\n", segment.Id, err)
+		}
+		keptSegments = append(keptSegments, segment)
+	}
+	a.Segments = keptSegments
+}
+
+// expiresBefore reports whether the segment at path may hold entries past
+// their retention at now. Entries are appended in time order, so the first
+// entry is the oldest. A segment last written before the longest retention
+// holds nothing but expired entries.
+func expiresBefore(path string, now time.Time, shortest, longest time.Duration, keys *crypt.Keyring) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if longest > 0 && info.ModTime().Before(now.Add(-longest)) {
+		return true
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := newLineReader(file, keys)
+	for scanner.Scan() {
+		var entry app.LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			return entry.Timestamp.Before(now.Add(-shortest))
+		}
+	}
+	return false
+}
+
+// rewriteSegment rewrites the segment at path with only the entries keep
+// accepts, going through a temporary file and a rename. Unparsable lines
+// are dropped as well, but a line that cannot be decrypted fails the
+// rewrite. The result is sealed with the active key of keys, if any. The
+// file is left untouched when nothing is dropped, and removed when nothing
+// is kept unless keepEmpty is set.
+func rewriteSegment(path string, keep func(app.LogEntry) bool, keepEmpty bool, keys *crypt.Keyring) (kept, dropped int, err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".retention-*")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	out := bufio.NewWriter(tmp)
+	lw := newLineWriter(out, keys)
+	scanner := newLineReader(src, keys)
+	for scanner.Scan() {
+		if err := scanner.DecodeErr(); err != nil {
+			return 0, 0, err
+		}
+		var entry app.LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil || !keep(entry) {
+			dropped++
+			continue
+		}
+		kept++
+		if err := lw.Write(scanner.Bytes()); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	if dropped == 0 {
+		return kept, 0, nil
+	}
+	if kept == 0 && !keepEmpty {
+		return 0, dropped, os.Remove(path)
+	}
+
+	if err := out.Flush(); err != nil {
+		return 0, 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, 0, err
+	}
+	return kept, dropped, os.Rename(tmp.Name(), path)
+}
+
+// reindexSegment drops the entries of seg that keep rejects and rebuilds
+// its index, since entry IDs are positions. path is the rewritten segment
+// file, holding just the entries kept; a mapped segment is remapped to it.
+func reindexSegment(seg *app.Segment, path string, keep func(app.LogEntry) bool, maxPerToken int, keys *crypt.Keyring) error {
+	if seg.Mapped != nil {
+		var pats []int
+		for id := 0; id < seg.Len(); id++ {
+			if keep(seg.Entry(id)) && id < len(seg.Patterns) {
+				pats = append(pats, seg.Patterns[id])
+			}
+		}
+		return mapSegment(seg, path, keep, replayPatterns(pats), maxPerToken, keys)
+	}
+
+	logs, pats := seg.Logs, seg.Patterns
+	seg.Logs, seg.Patterns = nil, nil
+	seg.Index = make(map[string]*app.PostingList)
+	seg.Fields = nil
+	seg.Tokens = 0
+	seg.MinTime, seg.MaxTime = time.Time{}, time.Time{}
+
+	for i, entry := range logs {
+		if !keep(entry) {
+			continue
+		}
+		id := len(seg.Logs)
+		seg.Logs = append(seg.Logs, entry)
+		if i < len(pats) {
+			seg.Patterns = append(seg.Patterns, pats[i])
+		}
+		IndexEntry(seg, id, entry, maxPerToken)
+	}
+
+	// The writer appends after the rewritten lines
+	offsets, err := lineOffsets(path, keys)
+	seg.Offsets = offsets
+	return err
+}
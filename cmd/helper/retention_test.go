@@ -0,0 +1,101 @@
+package helper
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"watchlogs/cmd/internal/app"
+)
+
+func TestParseRetentionRules(t *testing.T) {
+	rules, err := ParseRetentionRules("level:error=168h, service:billing=720h")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rules) != 2 || rules[0] != (app.RetentionRule{Field: "level", Value: "error", Keep: 168 * time.Hour}) {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+
+	for _, v := range []string{"level=1h", "level:error", "level:error=soon"} {
+		if _, err := ParseRetentionRules(v); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := now.Add(-12 * time.Hour)
+
+	write := func(id int, entries ...app.LogEntry) {
+		f, err := os.Create(SegmentPath(dir, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		for _, e := range entries {
+			data, _ := json.Marshal(e)
+			f.Write(append(data, '\n'))
+		}
+	}
+
+	// Segment 1 is only on disk, segment 2 is the in-memory current one
+	write(1,
+		app.LogEntry{Timestamp: old, Level: "debug", Message: "cache miss"},
+		app.LogEntry{Timestamp: old, Level: "error", Message: "db timeout"},
+	)
+	write(2,
+		app.LogEntry{Timestamp: old, Level: "debug", Message: "cache miss"},
+		app.LogEntry{Timestamp: old, Level: "info", Message: "checkout done", Fields: map[string]string{"service": "billing"}},
+		app.LogEntry{Timestamp: now, Level: "debug", Message: "cache miss"},
+	)
+
+	a := &app.App{Cfg: app.Config{
+		DataPath:  dir,
+		Retention: 24 * time.Hour,
+		RetentionRules: []app.RetentionRule{
+			{Field: "level", Value: "debug", Keep: 6 * time.Hour},
+			{Field: "service", Value: "billing", Keep: time.Hour},
+		},
+	}}
+	seg, err := OpenSegment(2, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { seg.File.Close() }()
+	if err := ReadSegment(seg, SegmentPath(dir, 2), nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.CurrentSegment = seg
+	a.Segments = []*app.Segment{seg}
+
+	ApplyRetention(a, now)
+
+	cold := &app.Segment{}
+	if err := ReadSegment(cold, SegmentPath(dir, 1), nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(cold.Logs) != 1 || cold.Logs[0].Level != "error" {
+		t.Errorf("expected only the error entry left on disk in segment 1, got %+v", cold.Logs)
+	}
+
+	if len(seg.Logs) != 1 || !seg.Logs[0].Timestamp.Equal(now) {
+		t.Fatalf("expected only the recent entry in memory, got %+v", seg.Logs)
+	}
+	if ids := seg.Index["cache"].IDs(); len(ids) != 1 || ids[0] != 0 {
+		t.Errorf("expected index rebuilt with ID 0, got %v", ids)
+	}
+	if seg.Index["checkout"] != nil {
+		t.Error("expected dropped entry to be removed from the index")
+	}
+
+	// The writer keeps appending to the rewritten file
+	seg.File.Write([]byte("{}\n"))
+	data, _ := os.ReadFile(SegmentPath(dir, 2))
+	if n := strings.Count(string(data), "\n"); n != 2 {
+		t.Errorf("expected append to reach the rewritten file, got %d lines", n)
+	}
+}
@@ -0,0 +1,79 @@
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/crypt"
+	"watchlogs/cmd/internal/patterns"
+)
+
+// maxLineSize is the longest segment line that can be read back.
+const maxLineSize = 1024 * 1024
+
+// SegmentPath returns the path of the log file of segment id.
+func SegmentPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("seg-%06d.log", id))
+}
+
+// ListSegments returns the IDs of the segment files in dir, oldest first.
+func ListSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var id int
+		_, err := fmt.Sscanf(entry.Name(), "seg-%06d.log", &id)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// ReadSegment scans the log file at path into seg, indexing every entry
+// keep accepts. Encrypted segments are decrypted. Lines that are not valid
+// JSON, such as a torn write at the end of the file, are skipped. keep and
+// miner may be nil.
+func ReadSegment(seg *app.Segment, path string, keep func(app.LogEntry) bool, miner *patterns.Miner, keys *crypt.Keyring) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return ReadSegmentFrom(seg, file, keep, miner, keys)
+}
+
+// ReadSegmentFrom is ReadSegment reading the segment from r.
+func ReadSegmentFrom(seg *app.Segment, r io.Reader, keep func(app.LogEntry) bool, miner *patterns.Miner, keys *crypt.Keyring) error {
+	if seg.Index == nil {
+		seg.Index = make(map[string]*app.PostingList)
+	}
+
+	scanner := newLineReader(r, keys)
+	for scanner.Scan() {
+		var entry app.LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if keep == nil || keep(entry) {
+			logID := len(seg.Logs)
+			seg.Logs = append(seg.Logs, entry)
+			seg.Offsets = append(seg.Offsets, scanner.Offset())
+			seg.Patterns = append(seg.Patterns, miner.Add(entry.Message))
+			IndexEntry(seg, logID, entry, 0)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,209 @@
+package helper
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/crypt"
+)
+
+// SnapshotDir is the directory under DataPath that holds snapshots.
+const SnapshotDir = "snapshots"
+
+// Snapshot takes a point-in-time copy of the segments of a. The writer is
+// paused only while the current segment is synced and its written part
+// copied; sealed segments and their index sidecars are hard-linked, which
+// is safe since they are only ever replaced through a rename. The snapshot
+// gets its own manifest with checksums of every segment. Segments already
+// moved to the blob store are listed as remote, so a restore still finds
+// them there. It returns the snapshot directory and its manifest.
+func Snapshot(a *app.App) (string, *Manifest, error) {
+	a.StorageMu.Lock()
+	defer a.StorageMu.Unlock()
+
+	name := "snap-" + time.Now().UTC().Format("20060102T150405.000Z")
+	dir := filepath.Join(a.Cfg.DataPath, SnapshotDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, err
+	}
+
+	err := func() error {
+		a.Mu.Lock()
+		defer a.Mu.Unlock()
+
+		current := a.CurrentSegment
+		if err := current.File.Sync(); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(a.Cfg.DataPath)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := e.Name()
+			var id int
+			if e.IsDir() || !strings.HasPrefix(name, "seg-") {
+				continue
+			}
+			if _, err := fmt.Sscanf(name, "seg-%06d.", &id); err != nil {
+				continue
+			}
+			src := filepath.Join(a.Cfg.DataPath, name)
+			if name == filepath.Base(SegmentPath("", current.Id)) {
+				err = copyFile(src, filepath.Join(dir, name), current.Size)
+			} else {
+				err = os.Link(src, filepath.Join(dir, name))
+			}
+			if err != nil {
+				return fmt.Errorf("snapshot %s: %v", name, err)
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+
+	// Tiering only runs under StorageMu, so the remote segments are those
+	// of the live manifest
+	var remote []SegmentMeta
+	if a.Blobs != nil {
+		live, err := LoadManifest(a.Cfg.DataPath)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+		for _, meta := range live.Segments {
+			if meta.Remote {
+				remote = append(remote, meta)
+			}
+		}
+	}
+
+	// Everything in the snapshot is now immutable, so it is all sealed
+	m, err := describeAll(dir, remote, a.Keys)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return dir, m, nil
+}
+
+// describeAll writes a manifest for every segment in dir, treating all of
+// them as sealed, plus the remote segments that have no file in dir.
+func describeAll(dir string, remote []SegmentMeta, keys *crypt.Keyring) (*Manifest, error) {
+	ids, err := ListSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{Updated: time.Now(), Segments: []SegmentMeta{}}
+	for _, id := range ids {
+		meta, err := DescribeSegment(dir, id, true, keys)
+		if err != nil {
+			return nil, err
+		}
+		m.Segments = append(m.Segments, meta)
+	}
+	for _, meta := range remote {
+		if !slices.Contains(ids, meta.Id) {
+			m.Segments = append(m.Segments, meta)
+		}
+	}
+	sort.Slice(m.Segments, func(i, j int) bool { return m.Segments[i].Id < m.Segments[j].Id })
+	return m, WriteManifest(dir, m)
+}
+
+// Restore rebuilds the data directory dataDir from the snapshot in
+// snapshotDir. dataDir must not contain segments yet. Every segment is
+// checked against the snapshot manifest before anything is copied, and the
+// files are copied rather than linked so the restored server cannot modify
+// the snapshot. Remote segments are carried over into the new manifest and
+// stay in the blob store.
+func Restore(snapshotDir, dataDir string, keys *crypt.Keyring) error {
+	m, err := LoadManifest(snapshotDir)
+	if err != nil {
+		return err
+	}
+	if len(m.Segments) == 0 {
+		return fmt.Errorf("%s has no snapshot manifest", snapshotDir)
+	}
+	if ids, _ := ListSegments(dataDir); len(ids) > 0 {
+		return fmt.Errorf("%s already holds %d segments", dataDir, len(ids))
+	}
+
+	var remote []SegmentMeta
+	currentID := 0
+	for _, meta := range m.Segments {
+		if meta.Remote {
+			remote = append(remote, meta)
+			continue
+		}
+		currentID = meta.Id
+		got, err := DescribeSegment(snapshotDir, meta.Id, true, keys)
+		if err != nil {
+			return err
+		}
+		if got.Checksum != meta.Checksum {
+			return fmt.Errorf("segment %d of the snapshot does not match its checksum", meta.Id)
+		}
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "seg-") {
+			continue
+		}
+		if err := copyFile(filepath.Join(snapshotDir, e.Name()), filepath.Join(dataDir, e.Name()), -1); err != nil {
+			return err
+		}
+	}
+	if currentID == 0 {
+		// Only remote segments, the server starts a new one past them
+		currentID = m.Segments[len(m.Segments)-1].Id + 1
+	}
+	if len(remote) > 0 {
+		// RefreshManifest keeps the remote entries it finds
+		if err := WriteManifest(dataDir, &Manifest{Updated: time.Now(), Segments: remote}); err != nil {
+			return err
+		}
+	}
+	return RefreshManifest(dataDir, currentID, keys)
+}
+
+// copyFile copies the first n bytes of src, or all of it when n is
+// negative, to a new file dst and syncs it.
+func copyFile(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var r io.Reader = in
+	if n >= 0 {
+		r = io.LimitReader(in, n)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+	return out.Sync()
+}
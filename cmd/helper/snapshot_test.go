@@ -0,0 +1,106 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/blob"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeSegment(t, dir, 1, app.LogEntry{Timestamp: now, Message: "sealed"})
+	writeSegment(t, dir, 2, app.LogEntry{Timestamp: now, Message: "current"})
+
+	current, err := OpenSegment(2, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.File.Close()
+	a := &app.App{Cfg: app.Config{DataPath: dir}, CurrentSegment: current}
+
+	snap, m, err := Snapshot(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Segments) != 2 || !m.Segments[1].Sealed || m.Segments[1].Checksum == "" {
+		t.Fatalf("expected a sealed manifest entry per segment, got %+v", m.Segments)
+	}
+
+	// Later writes must not leak into the snapshot
+	current.File.WriteString(`{"message":"after"}` + "\n")
+
+	restored := filepath.Join(t.TempDir(), "data")
+	if err := Restore(snap, restored, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := ListSegments(restored); !slices.Equal(ids, []int{1, 2}) {
+		t.Fatalf("expected segments 1 and 2 restored, got %v", ids)
+	}
+	seg := &app.Segment{}
+	ReadSegment(seg, SegmentPath(restored, 2), nil, nil, nil)
+	if len(seg.Logs) != 1 || seg.Logs[0].Message != "current" {
+		t.Errorf("expected current segment as of the snapshot, got %+v", seg.Logs)
+	}
+
+	if err := Restore(snap, restored, nil); err == nil {
+		t.Error("expected restore into a non-empty data directory to fail")
+	}
+
+	// A corrupted snapshot is refused
+	os.WriteFile(SegmentPath(snap, 1), []byte("tampered\n"), 0644)
+	if err := Restore(snap, filepath.Join(t.TempDir(), "data"), nil); err == nil {
+		t.Error("expected checksum mismatch to fail the restore")
+	}
+}
+
+func TestSnapshotRestoreRemote(t *testing.T) {
+	dir := t.TempDir()
+	store, err := blob.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	old := now.Add(-3 * time.Hour)
+	writeSegment(t, dir, 1, app.LogEntry{Timestamp: old, Message: "cold"})
+	os.Chtimes(SegmentPath(dir, 1), old, old)
+	writeSegment(t, dir, 2, app.LogEntry{Timestamp: now, Message: "current"})
+
+	current, err := OpenSegment(2, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.File.Close()
+	a := &app.App{
+		Cfg:            app.Config{DataPath: dir, WarmAge: time.Hour},
+		Blobs:          store,
+		Segments:       []*app.Segment{current},
+		CurrentSegment: current,
+	}
+	RefreshManifest(dir, 2, nil)
+	Tier(a, now)
+
+	snap, m, err := Snapshot(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Segments) != 2 || m.Segments[0].Id != 1 || !m.Segments[0].Remote {
+		t.Fatalf("expected the remote segment in the snapshot manifest, got %+v", m.Segments)
+	}
+
+	restored := filepath.Join(t.TempDir(), "data")
+	if err := Restore(snap, restored, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := ListSegments(restored); !slices.Equal(ids, []int{2}) {
+		t.Fatalf("expected only segment 2 restored to disk, got %v", ids)
+	}
+	got, _ := LoadManifest(restored)
+	if len(got.Segments) != 2 || !got.Segments[0].Remote || got.Segments[0].Checksum != m.Segments[0].Checksum {
+		t.Errorf("expected the remote segment carried over, got %+v", got.Segments)
+	}
+}
@@ -0,0 +1,206 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"watchlogs/cmd/internal/app"
+)
+
+// blobKey returns the blob store key of a file of DataPath.
+func blobKey(name string) string {
+	return "segments/" + name
+}
+
+// Tier moves sealed segments that are no longer in memory and were last
+// written more than WarmAge ago to the blob store, together with their
+// index sidecars, and deletes the local copies. Remote segments past the
+// longest retention are deleted from the blob store. Nothing happens when
+// no blob store or warm age is configured.
+func Tier(a *app.App, now time.Time) {
+	if a.Blobs == nil || a.Cfg.WarmAge <= 0 {
+		return
+	}
+	a.StorageMu.Lock()
+	defer a.StorageMu.Unlock()
+
+	ids, err := ListSegments(a.Cfg.DataPath)
+	if err != nil {
+		log.Printf("Failed to list segments for tiering: %v\n", err)
+		return
+	}
+	a.Mu.Lock()
+	firstHot := -1
+	if len(a.Segments) > 0 {
+		firstHot = a.Segments[0].Id
+	}
+	a.Mu.Unlock()
+
+	for _, id := range ids {
+		if firstHot >= 0 && id >= firstHot {
+			break
+		}
+		info, err := os.Stat(SegmentPath(a.Cfg.DataPath, id))
+		if err != nil || !info.ModTime().Before(now.Add(-a.Cfg.WarmAge)) {
+			continue
+		}
+		if err := uploadSegment(a, id); err != nil {
+			log.Printf("Failed to move segment %d to the blob store: %v\n", id, err)
+			continue
+		}
+		log.Printf("Moved segment %d to the blob store\n", id)
+	}
+
+	if _, longest := retentionBounds(a.Cfg); longest > 0 {
+		expireRemote(a, now.Add(-longest))
+	}
+}
+
+// segmentFiles returns the names of the files of segment id in dir: the
+// log file and its sidecars.
+func segmentFiles(dir string, id int) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("seg-%06d.*", id)))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range matches {
+		names = append(names, filepath.Base(m))
+	}
+	return names, nil
+}
+
+// uploadSegment copies the files of segment id to the blob store, marks it
+// remote in the manifest and only then removes the local files, so a crash
+// at any point leaves a readable copy.
+func uploadSegment(a *app.App, id int) error {
+	dir := a.Cfg.DataPath
+	meta, err := DescribeSegment(dir, id, true, a.Keys)
+	if err != nil {
+		return err
+	}
+	names, err := segmentFiles(dir, id)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err == nil {
+			err = a.Blobs.Put(ctx, blobKey(name), f, info.Size())
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	meta.Remote = true
+	err = updateManifest(dir, func(m *Manifest) {
+		m.Segments = withoutSegment(m.Segments, id)
+		m.Segments = append(m.Segments, meta)
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		os.Remove(filepath.Join(dir, name))
+	}
+	return nil
+}
+
+// expireRemote deletes remote segments whose newest entry is older than
+// cutoff from the blob store and the manifest.
+func expireRemote(a *app.App, cutoff time.Time) {
+	m, err := LoadManifest(a.Cfg.DataPath)
+	if err != nil {
+		log.Printf("Failed to read the manifest for remote retention: %v\n", err)
+		return
+	}
+
+	ctx := context.Background()
+	for _, meta := range m.Segments {
+		if !meta.Remote || !meta.MaxTime.Before(cutoff) {
+			continue
+		}
+		keys, err := a.Blobs.List(ctx, blobKey(fmt.Sprintf("seg-%06d.", meta.Id)))
+		if err == nil {
+			for _, key := range keys {
+				if err = a.Blobs.Delete(ctx, key); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to delete remote segment %d: %v\n", meta.Id, err)
+			continue
+		}
+		updateManifest(a.Cfg.DataPath, func(m *Manifest) {
+			m.Segments = withoutSegment(m.Segments, meta.Id)
+		})
+		log.Printf("Deleted remote segment %d past retention\n", meta.Id)
+	}
+}
+
+func withoutSegment(metas []SegmentMeta, id int) []SegmentMeta {
+	kept := metas[:0]
+	for _, meta := range metas {
+		if meta.Id != id {
+			kept = append(kept, meta)
+		}
+	}
+	return kept
+}
+
+// ColdSegmentIDs returns the IDs of the segments older than below, both
+// on local disk and in the blob store, oldest first.
+func ColdSegmentIDs(a *app.App, below int) []int {
+	seen := make(map[int]bool)
+	var ids []int
+	add := func(id int) {
+		if (below < 0 || id < below) && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	local, err := ListSegments(a.Cfg.DataPath)
+	if err != nil {
+		log.Printf("Failed to list segments: %v\n", err)
+	}
+	for _, id := range local {
+		add(id)
+	}
+	if a.Blobs != nil {
+		if m, err := LoadManifest(a.Cfg.DataPath); err == nil {
+			for _, meta := range m.Segments {
+				if meta.Remote {
+					add(meta.Id)
+				}
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// OpenSegmentData opens the log file of segment id, from local disk when
+// it is there and otherwise fetching it from the blob store.
+func OpenSegmentData(ctx context.Context, a *app.App, id int) (io.ReadCloser, error) {
+	path := SegmentPath(a.Cfg.DataPath, id)
+	f, err := os.Open(path)
+	if err == nil || a.Blobs == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+	return a.Blobs.Get(ctx, blobKey(filepath.Base(path)))
+}
@@ -0,0 +1,80 @@
+package helper
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+	"time"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/blob"
+)
+
+func TestTier(t *testing.T) {
+	dir := t.TempDir()
+	store, err := blob.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	old := now.Add(-3 * time.Hour)
+
+	writeSegment(t, dir, 1, app.LogEntry{Timestamp: old, Message: "cold entry"})
+	if err := buildBloom(dir, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(SegmentPath(dir, 1), old, old)
+	writeSegment(t, dir, 2, app.LogEntry{Timestamp: now, Message: "hot entry"})
+
+	current := &app.Segment{Id: 2}
+	a := &app.App{
+		Cfg:            app.Config{DataPath: dir, WarmAge: time.Hour, Retention: 24 * time.Hour},
+		Blobs:          store,
+		Segments:       []*app.Segment{current},
+		CurrentSegment: current,
+	}
+	RefreshManifest(dir, 2, nil)
+
+	Tier(a, now)
+
+	if ids, _ := ListSegments(dir); !slices.Equal(ids, []int{2}) {
+		t.Fatalf("expected segment 1 moved off local disk, got %v", ids)
+	}
+	if keys, _ := store.List(context.Background(), "segments/"); len(keys) != 2 {
+		t.Errorf("expected log and sidecar uploaded, got %v", keys)
+	}
+	if ids := ColdSegmentIDs(a, 2); !slices.Equal(ids, []int{1}) {
+		t.Errorf("expected remote segment 1 to be listed as cold, got %v", ids)
+	}
+
+	data, err := OpenSegmentData(context.Background(), a, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := &app.Segment{}
+	ReadSegmentFrom(seg, data, nil, nil, nil)
+	data.Close()
+	if len(seg.Logs) != 1 || seg.Logs[0].Message != "cold entry" {
+		t.Errorf("expected remote segment fetched on demand, got %+v", seg.Logs)
+	}
+	if f, err := LoadBloom(context.Background(), a, 1); err != nil || f == nil || !f.Test("cold") || f.Test("hot") {
+		t.Errorf("expected bloom filter of remote segment fetched, got %v", err)
+	}
+
+	// Manifest reconciliation accepts the remote segment
+	if problems, _ := ReconcileManifest(dir, 2, nil); len(problems) != 0 {
+		t.Errorf("unexpected discrepancies %q", problems)
+	}
+
+	// Past retention the remote copy is deleted too
+	Tier(a, now.Add(48*time.Hour))
+	if keys, _ := store.List(context.Background(), "segments/"); len(keys) != 0 {
+		t.Errorf("expected remote segment deleted past retention, got %v", keys)
+	}
+	if ids := ColdSegmentIDs(a, 2); len(ids) != 0 {
+		t.Errorf("expected no cold segments left, got %v", ids)
+	}
+	if _, err := OpenSegmentData(context.Background(), a, 1); err != blob.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -2,51 +2,132 @@ package helper
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"os"
+	"sync/atomic"
+	"time"
 	"watchlogs/cmd/internal/app"
 )
 
+// writeRetries is how many times a failed write is retried before the
+// entry is dropped. The wait starts at writeBackoff and doubles each time.
+var (
+	writeRetries = 5
+	writeBackoff = 50 * time.Millisecond
+)
+
 func Writer(logCh <-chan app.LogEntry, a *app.App) {
 	log.Println("Starting log writer goroutine...")
 
 	for entry := range logCh {
 		// Serialize log entry to JSON
-		data, _ := json.Marshal(entry)
-		a.Mu.Lock()
+		data, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("Dropping log entry that cannot be encoded: %v\n", err)
+			atomic.AddInt64(&a.Metrics.Dropped, 1)
+			continue
+		}
+
+		for attempt := 0; ; attempt++ {
+			err := commit(a, entry, data)
+			if err == nil {
+				if atomic.SwapInt64(&a.Metrics.Degraded, 0) == 1 {
+					log.Println("Writes are succeeding again, leaving degraded state")
+				}
+				break
+			}
+
+			if atomic.SwapInt64(&a.Metrics.Degraded, 1) == 0 {
+				log.Printf("Write failed, entering degraded state: %v\n", err)
+			}
+			if attempt == writeRetries {
+				log.Printf("Dropping log entry after %d failed writes: %v\n", attempt+1, err)
+				atomic.AddInt64(&a.Metrics.Dropped, 1)
+				break
+			}
+			// Wait without holding the lock so searches keep running
+			time.Sleep(writeBackoff << attempt)
+		}
+	}
+}
 
-		id := len(a.CurrentSegment.Logs)
-		log.Printf("Writing log entry with ID %d\n", id)
-		a.CurrentSegment.Logs = append(a.CurrentSegment.Logs, entry)
+// commit appends the encoded entry to the current segment file and, only
+// once it is on disk, adds it to the in-memory segment. A partial write is
+// truncated away so memory and disk stay in step.
+func commit(a *app.App, entry app.LogEntry, data []byte) error {
+	a.Mu.Lock()
+	defer a.Mu.Unlock()
 
-		for _, token := range Tokenize(entry.Message) {
-			ids := a.CurrentSegment.Index[token]
-			if len(ids) >= a.Cfg.MaxPerToken {
-				ids = ids[1:] // Remove oldest ID to maintain size
+	seg := a.CurrentSegment
+	line, err := encodeLine(seg.KeyID, data, a.Keys)
+	if err != nil {
+		return err
+	}
+	n, err := seg.File.Write(line)
+	if err != nil {
+		if n > 0 {
+			if terr := seg.File.Truncate(seg.Size); terr != nil {
+				return fmt.Errorf("%v, and truncating the partial write failed: %v", err, terr)
 			}
-			ids = append(ids, id)
-			a.CurrentSegment.Index[token] = ids
 		}
+		return err
+	}
+	id := len(seg.Logs)
+	log.Printf("Writing log entry with ID %d\n", id)
+	seg.Logs = append(seg.Logs, entry)
+	seg.Offsets = append(seg.Offsets, seg.Size)
+	seg.Size += int64(n)
+	seg.Patterns = append(seg.Patterns, a.Patterns.Add(entry.Message))
 
-		n, _ := a.CurrentSegment.File.Write(append(data, '\n'))
-		a.CurrentSegment.Size += int64(n)
+	IndexEntry(seg, id, entry, a.Cfg.MaxPerToken)
 
-		// Check if we need to rotate the segment after writing
-		if a.Cfg.MaxSegSize > 0 && a.CurrentSegment.Size >= a.Cfg.MaxSegSize {
-			log.Printf("Current segment size %d exceeds max segment size %d, rotating segment...\n", a.CurrentSegment.Size, a.Cfg.MaxSegSize)
+	for _, o := range a.Observers {
+		o.Observe(entry)
+	}
 
-			a.CurrentSegment.File.Sync()
-			a.CurrentSegment.File.Close()
+	// Check if we need to rotate the segment after writing
+	if a.Cfg.MaxSegSize > 0 && seg.Size >= a.Cfg.MaxSegSize {
+		log.Printf("Current segment size %d exceeds max segment size %d, rotating segment...\n", seg.Size, a.Cfg.MaxSegSize)
 
-			nextID := a.CurrentSegment.Id + 1
-			newSeg, err := OpenSegment(nextID, a.Cfg.DataPath)
-			if err != nil {
-				log.Fatalf("Failed to open new segment: %v\n", err)
-			}
+		// Open the next segment first, so a failure leaves the current
+		// one in place to be rotated after a later write
+		nextID := seg.Id + 1
+		newSeg, err := OpenSegment(nextID, a.Cfg.DataPath, a.Keys)
+		if err != nil {
+			log.Printf("Failed to open new segment, staying on segment %d: %v\n", seg.Id, err)
+			return nil
+		}
+
+		seg.File.Sync()
+		sealedFile, _ := seg.File.Stat()
+		seg.File.Close()
 
-			a.CurrentSegment = newSeg
-			a.Segments = append(a.Segments, newSeg)
-			log.Printf("Rotated to new segment with ID %d\n", nextID)
+		// Sealed entries are read from the file from now on
+		if err := sealSegment(seg, a.Cfg.DataPath, a.Keys); err != nil {
+			log.Printf("Failed to map sealed segment %d, keeping it in memory: %v\n", seg.Id, err)
 		}
-		a.Mu.Unlock()
+		seg.Bloom = indexBloom(seg)
+		sealed, filter := seg.Id, seg.Bloom
+
+		a.CurrentSegment = newSeg
+		a.Segments = append(a.Segments, newSeg)
+		log.Printf("Rotated to new segment with ID %d\n", nextID)
+
+		// Record the sealed segment without holding up the writer, under
+		// StorageMu like every other change to segment files. A file that
+		// compaction, retention or tiering replaced or removed meanwhile
+		// got its bloom filter from them.
+		go func() {
+			a.StorageMu.Lock()
+			defer a.StorageMu.Unlock()
+			if info, err := os.Stat(SegmentPath(a.Cfg.DataPath, sealed)); err == nil && os.SameFile(info, sealedFile) {
+				if err := writeBloom(a.Cfg.DataPath, sealed, filter, a.Keys); err != nil {
+					log.Printf("Failed to write the bloom filter of segment %d: %v\n", sealed, err)
+				}
+			}
+			refreshManifest(a)
+		}()
 	}
+	return nil
 }
@@ -22,7 +22,7 @@ func TestWriter(t *testing.T) {
 		CurrentSegment: &app.Segment{
 			Id:    1,
 			File:  tempFile,
-			Index: make(map[string][]int),
+			Index: make(map[string]*app.PostingList),
 		},
 	}
 
@@ -44,3 +44,44 @@ func TestWriter(t *testing.T) {
 		t.Errorf("Expected message 'test log entry', got '%s'", a.CurrentSegment.Logs[0].Message)
 	}
 }
+
+func TestWriterWriteFailure(t *testing.T) {
+	retries, backoff := writeRetries, writeBackoff
+	writeRetries, writeBackoff = 2, time.Millisecond
+	defer func() { writeRetries, writeBackoff = retries, backoff }()
+
+	tempFile, err := os.CreateTemp("", "seg-*.log")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+	tempFile.Close() // Every write now fails
+
+	a := &app.App{
+		LogCh: make(chan app.LogEntry, 1),
+		CurrentSegment: &app.Segment{
+			Id:    1,
+			File:  tempFile,
+			Index: make(map[string]*app.PostingList),
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Writer(a.LogCh, a)
+		close(done)
+	}()
+	a.LogCh <- app.LogEntry{Timestamp: time.Now(), Level: "info", Message: "lost entry"}
+	close(a.LogCh)
+	<-done
+
+	if len(a.CurrentSegment.Logs) != 0 || len(a.CurrentSegment.Index) != 0 {
+		t.Errorf("expected failed write to stay out of memory, got %d entries", len(a.CurrentSegment.Logs))
+	}
+	if a.Metrics.Dropped != 1 {
+		t.Errorf("expected 1 dropped entry, got %d", a.Metrics.Dropped)
+	}
+	if a.Metrics.Degraded != 1 {
+		t.Error("expected writer to be degraded")
+	}
+}
@@ -0,0 +1,386 @@
+// Package alert evaluates alert rules against entries committed by the
+// writer and notifies webhooks when rules start or stop firing.
+package alert
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+)
+
+// Rule states.
+const (
+	StateInactive = "inactive"
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// ErrNotFound is returned for unknown rule names.
+var ErrNotFound = errors.New("alert rule not found")
+
+// Duration is a time.Duration written as a string such as "5m" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Rule fires when more than Threshold entries matching Query are written
+// within Window, and keeps doing so for at least For.
+type Rule struct {
+	Name      string   `json:"name"`
+	Query     string   `json:"query"`
+	Threshold int      `json:"threshold"`
+	Window    Duration `json:"window"`
+	For       Duration `json:"for"`
+	Webhook   string   `json:"webhook"`
+}
+
+// Validate checks the rule and returns its parsed query.
+func (r Rule) Validate() (*helper.Query, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if r.Window <= 0 {
+		return nil, fmt.Errorf("window must be positive")
+	}
+	if r.Threshold < 0 || r.For < 0 {
+		return nil, fmt.Errorf("threshold and for cannot be negative")
+	}
+	q, err := helper.ParseQuery(r.Query)
+	if err != nil {
+		return nil, err
+	}
+	if q == nil {
+		return nil, fmt.Errorf("query is required")
+	}
+	return q, nil
+}
+
+// Status is a rule together with its current evaluation.
+type Status struct {
+	Rule
+	State     string    `json:"state"`
+	Count     int       `json:"count"`
+	ActiveAt  time.Time `json:"activeAt,omitzero"`
+	ChangedAt time.Time `json:"changedAt,omitzero"`
+}
+
+// Notification is the JSON body posted to a rule's webhook.
+type Notification struct {
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	Query     string    `json:"query"`
+	Count     int       `json:"count"`
+	Threshold int       `json:"threshold"`
+	Window    Duration  `json:"window"`
+	At        time.Time `json:"at"`
+	webhook   string
+}
+
+type ruleState struct {
+	rule     Rule
+	query    *helper.Query
+	buckets  []bucket // matching entries inside the window, oldest first
+	count    int      // entries in buckets
+	state    string
+	activeAt time.Time
+	changed  time.Time
+}
+
+// bucket counts the matching entries timestamped within one second. An
+// entry leaves the window once its whole second has, so up to a second
+// late.
+type bucket struct {
+	sec int64 // unix seconds
+	n   int
+}
+
+// add counts a matching entry timestamped t.
+func (rs *ruleState) add(t time.Time) {
+	sec := t.Unix()
+	i, found := slices.BinarySearchFunc(rs.buckets, sec, func(b bucket, sec int64) int {
+		return cmp.Compare(b.sec, sec)
+	})
+	if found {
+		rs.buckets[i].n++
+	} else {
+		rs.buckets = slices.Insert(rs.buckets, i, bucket{sec: sec, n: 1})
+	}
+	rs.count++
+}
+
+// Manager holds the rules and their state. Rules are stored in a JSON file
+// which can also be edited by hand as a config file.
+type Manager struct {
+	mu     sync.Mutex
+	path   string
+	rules  map[string]*ruleState
+	notify chan Notification
+	client *http.Client
+}
+
+// NewManager loads the rules stored at path, a missing file meaning no
+// rules, and starts delivering notifications.
+func NewManager(path string) (*Manager, error) {
+	m := &Manager{
+		path:   path,
+		rules:  make(map[string]*ruleState),
+		notify: make(chan Notification, 100),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var rules []Rule
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("invalid rules file %s: %v", path, err)
+		}
+		for _, r := range rules {
+			q, err := r.Validate()
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %q: %v", r.Name, err)
+			}
+			m.rules[r.Name] = &ruleState{rule: r, query: q, state: StateInactive}
+		}
+	}
+
+	go m.deliver()
+	return m, nil
+}
+
+// Observe records a committed entry. It is called by the writer and only
+// updates in-memory counters; webhooks are called asynchronously.
+func (m *Manager) Observe(e app.LogEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.rules) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, rs := range m.rules {
+		if rs.query.MatchEntry(e) {
+			rs.add(e.Timestamp)
+			m.evaluate(rs, now)
+		}
+	}
+}
+
+// Evaluate re-checks every rule at now, which moves rules through their
+// for duration and resolves them once matching entries stop.
+func (m *Manager) Evaluate(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rs := range m.rules {
+		m.evaluate(rs, now)
+	}
+}
+
+// Run evaluates the rules every interval.
+func (m *Manager) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		m.Evaluate(now)
+	}
+}
+
+func (m *Manager) evaluate(rs *ruleState, now time.Time) {
+	cutoff := now.Add(-time.Duration(rs.rule.Window))
+	keep := 0
+	for keep < len(rs.buckets) && !time.Unix(rs.buckets[keep].sec+1, 0).After(cutoff) {
+		rs.count -= rs.buckets[keep].n
+		keep++
+	}
+	rs.buckets = rs.buckets[keep:]
+	active := rs.count > rs.rule.Threshold
+
+	switch {
+	case active && (rs.state == StateInactive || rs.state == StateResolved):
+		rs.activeAt = now
+		m.transition(rs, StatePending, now)
+		if rs.rule.For == 0 {
+			m.transition(rs, StateFiring, now)
+		}
+	case active && rs.state == StatePending:
+		if now.Sub(rs.activeAt) >= time.Duration(rs.rule.For) {
+			m.transition(rs, StateFiring, now)
+		}
+	case !active && rs.state == StatePending:
+		m.transition(rs, StateInactive, now)
+	case !active && rs.state == StateFiring:
+		m.transition(rs, StateResolved, now)
+	}
+}
+
+func (m *Manager) transition(rs *ruleState, state string, now time.Time) {
+	log.Printf("Alert rule %s: %s -> %s (%d matches in %s)\n", rs.rule.Name, rs.state, state, rs.count, time.Duration(rs.rule.Window))
+	rs.state = state
+	rs.changed = now
+
+	if (state == StateFiring || state == StateResolved) && rs.rule.Webhook != "" {
+		n := Notification{
+			Rule:      rs.rule.Name,
+			State:     state,
+			Query:     rs.rule.Query,
+			Count:     rs.count,
+			Threshold: rs.rule.Threshold,
+			Window:    rs.rule.Window,
+			At:        now,
+			webhook:   rs.rule.Webhook,
+		}
+		select {
+		case m.notify <- n:
+		default:
+			log.Printf("Alert notification queue is full, dropping %s notification for %s\n", state, rs.rule.Name)
+		}
+	}
+}
+
+// deliver posts queued notifications, retrying failed ones with backoff.
+func (m *Manager) deliver() {
+	for n := range m.notify {
+		body, _ := json.Marshal(n)
+		backoff := time.Second
+		for attempt := 1; attempt <= 3; attempt++ {
+			res, err := m.client.Post(n.webhook, "application/json", bytes.NewReader(body))
+			if err == nil {
+				res.Body.Close()
+				if res.StatusCode < 300 {
+					break
+				}
+				err = fmt.Errorf("status %d", res.StatusCode)
+			}
+			log.Printf("Failed to notify webhook for rule %s (attempt %d): %v\n", n.Rule, attempt, err)
+			if attempt < 3 {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// Rules returns the status of every rule ordered by name.
+func (m *Manager) Rules() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]Status, 0, len(m.rules))
+	for _, rs := range m.rules {
+		list = append(list, rs.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Get returns the status of the rule called name.
+func (m *Manager) Get(name string) (Status, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rs, ok := m.rules[name]
+	if !ok {
+		return Status{}, ErrNotFound
+	}
+	return rs.status(), nil
+}
+
+// Put creates or replaces a rule and saves the rules file. Replacing a
+// rule resets its state.
+func (m *Manager) Put(r Rule) error {
+	q, err := r.Validate()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.rules[r.Name]
+	m.rules[r.Name] = &ruleState{rule: r, query: q, state: StateInactive}
+	if err := m.save(); err != nil {
+		if prev != nil {
+			m.rules[r.Name] = prev
+		} else {
+			delete(m.rules, r.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the rule called name and saves the rules file.
+func (m *Manager) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev, ok := m.rules[name]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(m.rules, name)
+	if err := m.save(); err != nil {
+		m.rules[name] = prev
+		return err
+	}
+	return nil
+}
+
+func (rs *ruleState) status() Status {
+	return Status{
+		Rule:      rs.rule,
+		State:     rs.state,
+		Count:     rs.count,
+		ActiveAt:  rs.activeAt,
+		ChangedAt: rs.changed,
+	}
+}
+
+// save writes the rules through a temporary file and a rename.
+func (m *Manager) save() error {
+	rules := make([]Rule, 0, len(m.rules))
+	for _, rs := range m.rules {
+		rules = append(rules, rs.rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(m.path), "."+filepath.Base(m.path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
@@ -0,0 +1,144 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+	"watchlogs/cmd/internal/app"
+)
+
+func TestRuleLifecycle(t *testing.T) {
+	received := make(chan Notification, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		json.NewDecoder(r.Body).Decode(&n)
+		received <- n
+	}))
+	defer webhook.Close()
+
+	path := filepath.Join(t.TempDir(), "alert_rules.json")
+	m, err := NewManager(path)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+
+	err = m.Put(Rule{
+		Name:      "payment-errors",
+		Query:     "level:error AND payment",
+		Threshold: 2,
+		Window:    Duration(5 * time.Minute),
+		For:       Duration(time.Minute),
+		Webhook:   webhook.URL,
+	})
+	if err != nil {
+		t.Fatalf("failed to add rule: %v", err)
+	}
+
+	now := time.Now()
+	m.Observe(app.LogEntry{Timestamp: now, Level: "INFO", Message: "payment ok"})
+	for range 3 {
+		m.Observe(app.LogEntry{Timestamp: now, Level: "ERROR", Message: "payment declined"})
+	}
+
+	state := func() Status {
+		s, err := m.Get("payment-errors")
+		if err != nil {
+			t.Fatalf("failed to get rule: %v", err)
+		}
+		return s
+	}
+	if s := state(); s.State != StatePending || s.Count != 3 {
+		t.Fatalf("expected pending with 3 matches, got %s with %d", s.State, s.Count)
+	}
+
+	m.Evaluate(now.Add(2 * time.Minute))
+	if s := state(); s.State != StateFiring {
+		t.Fatalf("expected firing after for duration, got %s", s.State)
+	}
+	select {
+	case n := <-received:
+		if n.State != StateFiring || n.Rule != "payment-errors" || n.Count != 3 {
+			t.Errorf("unexpected notification %+v", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected firing notification")
+	}
+
+	m.Evaluate(now.Add(6 * time.Minute))
+	if s := state(); s.State != StateResolved {
+		t.Fatalf("expected resolved once window passed, got %s", s.State)
+	}
+	select {
+	case n := <-received:
+		if n.State != StateResolved {
+			t.Errorf("expected resolved notification, got %+v", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected resolved notification")
+	}
+
+	// Rules survive a restart through the rules file
+	reloaded, err := NewManager(path)
+	if err != nil {
+		t.Fatalf("failed to reload rules: %v", err)
+	}
+	if rules := reloaded.Rules(); len(rules) != 1 || rules[0].Threshold != 2 || rules[0].State != StateInactive {
+		t.Errorf("unexpected reloaded rules %+v", rules)
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	for _, r := range []Rule{
+		{Name: "", Query: "x", Window: Duration(time.Minute)},
+		{Name: "a", Query: "", Window: Duration(time.Minute)},
+		{Name: "a", Query: "x"},
+		{Name: "a", Query: "(x", Window: Duration(time.Minute)},
+	} {
+		if _, err := r.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", r)
+		}
+	}
+}
+
+func TestRuleWindowBuckets(t *testing.T) {
+	m, err := NewManager(filepath.Join(t.TempDir(), "alert_rules.json"))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	if err := m.Put(Rule{Name: "timeouts", Query: "timeout", Threshold: 1000, Window: Duration(time.Minute)}); err != nil {
+		t.Fatalf("failed to add rule: %v", err)
+	}
+
+	// Many entries share a second, and a late one arrives out of order
+	start := time.Now().Truncate(time.Second)
+	for i := range 500 {
+		m.Observe(app.LogEntry{Timestamp: start.Add(time.Duration(i) * time.Millisecond), Message: "db timeout"})
+		m.Observe(app.LogEntry{Timestamp: start.Add(30 * time.Second), Message: "db timeout"})
+	}
+	m.Observe(app.LogEntry{Timestamp: start.Add(10 * time.Second), Message: "late timeout"})
+
+	m.mu.Lock()
+	buckets := len(m.rules["timeouts"].buckets)
+	m.mu.Unlock()
+	if buckets != 3 {
+		t.Errorf("expected one bucket per second, got %d", buckets)
+	}
+
+	count := func(now time.Time) int {
+		m.Evaluate(now)
+		s, _ := m.Get("timeouts")
+		return s.Count
+	}
+	if n := count(start.Add(30 * time.Second)); n != 1001 {
+		t.Errorf("expected 1001 matches in the window, got %d", n)
+	}
+	if n := count(start.Add(61 * time.Second)); n != 501 {
+		t.Errorf("expected the first second to leave the window, got %d", n)
+	}
+	if n := count(start.Add(91 * time.Second)); n != 0 {
+		t.Errorf("expected an empty window, got %d", n)
+	}
+}
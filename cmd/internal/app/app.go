@@ -4,21 +4,40 @@ import (
 	"os"
 	"sync"
 	"time"
+
+	"watchlogs/cmd/internal/blob"
+	"watchlogs/cmd/internal/bloom"
+	"watchlogs/cmd/internal/crypt"
+	"watchlogs/cmd/internal/patterns"
+	"watchlogs/cmd/internal/saved"
 )
 
 type App struct {
 	Mu             sync.Mutex
+	StorageMu      sync.Mutex // serializes rewrites and removals of segment files
 	LogCh          chan LogEntry
 	Metrics        Metrics
 	Cfg            Config
 	CurrentSegment *Segment
 	Segments       []*Segment
+	Patterns       *patterns.Miner
+	Saved          *saved.Store
+	Observers      []Observer
+	Blobs          blob.Store     // where sealed segments past WarmAge go, nil to keep them local
+	Keys           *crypt.Keyring // encrypts new segments at rest, nil to write plaintext
+}
+
+// Observer is notified by the writer of every entry it commits, while
+// App.Mu is held. Implementations must not block.
+type Observer interface {
+	Observe(entry LogEntry)
 }
 
 type LogEntry struct {
-	Timestamp time.Time `json:"timestamp"` // Write `json:"timestamp"` to specify JSON key because field name is capitalized in Go but should be lowercase in JSON
-	Level     string    `json:"level"`
-	Message   string    `json:"message"`
+	Timestamp time.Time         `json:"timestamp"` // Write `json:"timestamp"` to specify JSON key because field name is capitalized in Go but should be lowercase in JSON
+	Level     string            `json:"level"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"` // Optional structured fields, e.g. service or region
 }
 
 type Metrics struct {
@@ -26,22 +45,143 @@ type Metrics struct {
 	TotalIngested int64     `json:"totalIngested"`
 	TotalSearched int64     `json:"totalSearched"`
 	StartTime     time.Time `json:"startTime"`
+	DiskUsed      int64     `json:"diskUsed"` // bytes under DataPath
+	DiskFree      int64     `json:"diskFree"` // bytes free on its filesystem, -1 if unknown
+	DiskLow       int64     `json:"diskLow"`  // 1 while ingest is refused for lack of space
+	Degraded      int64     `json:"degraded"` // 1 while segment writes are failing
+	Dropped       int64     `json:"dropped"`  // entries never written to disk
 }
 
 type Config struct {
-	Retention   time.Duration
-	MaxResults  int
-	ChannelSize int
-	DataPath    string
-	MaxPerToken int
-	MaxSegSize  int64
-	HotSegments int
+	Retention      time.Duration
+	RetentionRules []RetentionRule // checked in order before Retention
+	MaxResults     int
+	ChannelSize    int
+	DataPath       string
+	MaxPerToken    int
+	MaxSegSize     int64
+	HotSegments    int
+	Stopwords      map[string]bool
+	MaxQueryTime   time.Duration
+	AlertRules     string // path of the alert rules file
+	AlertInterval  time.Duration
+	DiskQuota      int64         // bytes allowed under DataPath, 0 for no quota
+	MinFreeDisk    int64         // free bytes below which ingest is refused
+	WarmAge        time.Duration // age after which sealed segments move to the blob store
+	BlobStore      string        // "dir:/path" or "s3://bucket/prefix", empty to disable tiering
+	S3             blob.S3Options
+	KeyFile        string // encryption keys, see crypt.Parse; ENCRYPTION_KEYS is used when empty
+}
+
+// RetentionRule keeps entries whose level or structured field Field
+// equals Value for Keep instead of the global Retention.
+type RetentionRule struct {
+	Field string
+	Value string
+	Keep  time.Duration
 }
 
 type Segment struct {
-	Id    int
-	File  *os.File
-	Size  int64
-	Logs  []LogEntry
-	Index map[string][]int
+	Id       int
+	File     *os.File
+	Size     int64
+	Logs     []LogEntry // entries of a segment not mapped yet, see Mapped
+	Offsets  []int64    // file offset of the line of each entry in Logs
+	Mapped   Entries    // entries of a sealed segment, read from its file on demand
+	Index    map[string]*PostingList
+	Fields   map[string]bool // names of the structured fields of indexed entries
+	Tokens   int             // total tokens indexed, used for average document length
+	Patterns []int           // pattern template ID of each entry in Logs
+	MinTime  time.Time
+	MaxTime  time.Time
+	KeyID    string        // key the file is encrypted with, empty for plaintext
+	Bloom    *bloom.Filter // tokens of a sealed segment, nil until sealed
+
+	readers int  // readers holding the segment outside App.Mu, see Hold
+	retired bool // removed from App.Segments, see Retire
+}
+
+// Hold keeps the segment intact for a reader that goes on using it after
+// releasing App.Mu, even if it is retired in the meantime. The reader
+// calls the returned function, with App.Mu held again, once it is done.
+// The caller must hold App.Mu.
+func (s *Segment) Hold() (done func()) {
+	s.readers++
+	return func() {
+		s.readers--
+		if s.retired && s.readers == 0 {
+			s.teardown()
+		}
+	}
+}
+
+// Retire tears down a segment removed from App.Segments as soon as no
+// reader holds it: its file is unmapped and its index dropped, leaving it
+// empty. The caller must hold App.Mu.
+func (s *Segment) Retire() {
+	s.retired = true
+	if s.readers == 0 {
+		s.teardown()
+	}
+}
+
+func (s *Segment) teardown() {
+	if s.Mapped != nil {
+		s.Mapped.Close()
+	}
+	s.Index = make(map[string]*PostingList)
+	s.Fields = nil
+}
+
+// Entries gives access to the entries of a sealed segment kept in its
+// file rather than in Segment.Logs. IDs are positions as in Logs. The
+// timestamp and level of each entry are answered without decoding it.
+type Entries interface {
+	Len() int
+	Entry(id int) LogEntry
+	Time(id int) time.Time
+	Level(id int) string
+	Close() error
+}
+
+// Len returns the number of entries in the segment.
+func (s *Segment) Len() int {
+	if s.Mapped != nil {
+		return s.Mapped.Len()
+	}
+	return len(s.Logs)
+}
+
+// Entry returns entry id of the segment, decoding it if the segment is
+// mapped. An entry that cannot be read is returned empty.
+func (s *Segment) Entry(id int) LogEntry {
+	if s.Mapped != nil {
+		return s.Mapped.Entry(id)
+	}
+	if id < 0 || id >= len(s.Logs) {
+		return LogEntry{}
+	}
+	return s.Logs[id]
+}
+
+// Time returns the timestamp of entry id.
+func (s *Segment) Time(id int) time.Time {
+	if s.Mapped != nil {
+		return s.Mapped.Time(id)
+	}
+	if id < 0 || id >= len(s.Logs) {
+		return time.Time{}
+	}
+	return s.Logs[id].Timestamp
+}
+
+// Level returns the level of entry id.
+func (s *Segment) Level(id int) string {
+	if s.Mapped != nil {
+		return s.Mapped.Level(id)
+	}
+	if id < 0 || id >= len(s.Logs) {
+		return ""
+	}
+	return s.Logs[id].Level
 }
@@ -0,0 +1,202 @@
+package app
+
+import "encoding/binary"
+
+// BlockSize is the number of IDs stored in one compressed block.
+const BlockSize = 128
+
+// PostingList is a sorted, append-only list of log IDs. IDs are stored as
+// varint-encoded deltas in fixed size blocks; each block keeps a skip entry
+// with its first and last ID so intersections can jump over whole blocks.
+type PostingList struct {
+	data    []byte
+	skips   []skip
+	n       int
+	dropped int
+}
+
+type skip struct {
+	first int // first ID in the block, stored here instead of in data
+	last  int // last ID in the block
+	off   int // byte offset of the block's deltas in data
+	count int // number of IDs in the block
+}
+
+// Len returns the number of IDs in the list. A nil list is empty.
+func (p *PostingList) Len() int {
+	if p == nil {
+		return 0
+	}
+	return p.n
+}
+
+// Truncated reports whether IDs were ever dropped from the list.
+func (p *PostingList) Truncated() bool {
+	return p != nil && p.dropped > 0
+}
+
+// SizeBytes returns the approximate memory used by the encoded list.
+func (p *PostingList) SizeBytes() int {
+	if p == nil {
+		return 0
+	}
+	return cap(p.data) + cap(p.skips)*32
+}
+
+// Last returns the largest ID in the list.
+func (p *PostingList) Last() (int, bool) {
+	if p.Len() == 0 {
+		return 0, false
+	}
+	return p.skips[len(p.skips)-1].last, true
+}
+
+// Add appends id to the list. IDs must be added in increasing order;
+// duplicates and out of order IDs are ignored.
+func (p *PostingList) Add(id int) {
+	if last, ok := p.Last(); ok && id <= last {
+		return
+	}
+
+	if len(p.skips) == 0 || p.skips[len(p.skips)-1].count == BlockSize {
+		p.skips = append(p.skips, skip{first: id, last: id, off: len(p.data), count: 1})
+		p.n++
+		return
+	}
+
+	b := &p.skips[len(p.skips)-1]
+	p.data = binary.AppendUvarint(p.data, uint64(id-b.last))
+	b.last = id
+	b.count++
+	p.n++
+}
+
+// DropFirst removes the oldest (smallest) ID from the list.
+func (p *PostingList) DropFirst() {
+	if p.Len() == 0 {
+		return
+	}
+
+	first := p.skips[0]
+	end := len(p.data)
+	if len(p.skips) > 1 {
+		end = p.skips[1].off
+	}
+
+	if first.count == 1 {
+		p.data = p.data[end:]
+		p.skips = p.skips[1:]
+		for i := range p.skips {
+			p.skips[i].off -= end
+		}
+		p.n--
+		p.dropped++
+		return
+	}
+
+	// The second ID becomes the block's first, so its delta is dropped
+	// and the remaining deltas are kept as they are.
+	delta, size := binary.Uvarint(p.data[first.off:])
+	p.data = p.data[size:]
+	for i := 1; i < len(p.skips); i++ {
+		p.skips[i].off -= size
+	}
+	p.skips[0].first += int(delta)
+	p.skips[0].count--
+	p.n--
+	p.dropped++
+}
+
+// IDs decodes the list into a slice.
+func (p *PostingList) IDs() []int {
+	ids := make([]int, 0, p.Len())
+	it := p.Iterator()
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// NewPostingList builds a list from sorted IDs.
+func NewPostingList(ids []int) *PostingList {
+	p := &PostingList{}
+	for _, id := range ids {
+		p.Add(id)
+	}
+	return p
+}
+
+// Iterator returns a cursor positioned before the first ID.
+func (p *PostingList) Iterator() *PostingIterator {
+	return &PostingIterator{list: p, block: -1}
+}
+
+// PostingIterator walks a PostingList in increasing ID order.
+type PostingIterator struct {
+	list  *PostingList
+	block int
+	pos   int // byte position in data
+	left  int // IDs left to read in the current block
+	cur   int
+	done  bool
+}
+
+// Next advances to the next ID.
+func (it *PostingIterator) Next() (int, bool) {
+	if it.done || it.list.Len() == 0 {
+		return 0, false
+	}
+	if it.left == 0 {
+		if it.block+1 >= len(it.list.skips) {
+			it.done = true
+			return 0, false
+		}
+		it.enter(it.block + 1)
+		return it.cur, true
+	}
+
+	delta, size := binary.Uvarint(it.list.data[it.pos:])
+	it.pos += size
+	it.cur += int(delta)
+	it.left--
+	return it.cur, true
+}
+
+// SkipTo advances to the first ID greater than or equal to target, using
+// the block skip entries to avoid decoding blocks that cannot contain it.
+func (it *PostingIterator) SkipTo(target int) (int, bool) {
+	if it.done || it.list.Len() == 0 {
+		return 0, false
+	}
+	if it.block >= 0 && it.cur >= target {
+		return it.cur, true
+	}
+
+	skips := it.list.skips
+	b := max(it.block, 0)
+	for b < len(skips) && skips[b].last < target {
+		b++
+	}
+	if b >= len(skips) {
+		it.done = true
+		return 0, false
+	}
+	if b != it.block {
+		it.enter(b)
+	}
+
+	for it.cur < target {
+		if _, ok := it.Next(); !ok {
+			return 0, false
+		}
+	}
+	return it.cur, true
+}
+
+func (it *PostingIterator) enter(b int) {
+	s := it.list.skips[b]
+	it.block = b
+	it.pos = s.off
+	it.cur = s.first
+	it.left = s.count - 1
+}
@@ -0,0 +1,46 @@
+// Package blob stores sealed segments in a local directory or an
+// S3-compatible object store.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrNotFound is returned by Get for keys that do not exist.
+var ErrNotFound = errors.New("blob not found")
+
+// Store is a flat key/value store of immutable blobs.
+type Store interface {
+	// Put stores size bytes read from r under key, replacing any blob
+	// already there.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the blob under key. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob under key. Deleting a missing key is not an
+	// error.
+	Delete(ctx context.Context, key string) error
+	// List returns the keys starting with prefix, sorted.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Open returns the store described by spec: "dir:/path" for a local
+// directory or "s3://bucket/prefix" for an S3-compatible store reached
+// with opts.
+func Open(spec string, opts S3Options) (Store, error) {
+	switch {
+	case strings.HasPrefix(spec, "dir:"):
+		return NewLocal(strings.TrimPrefix(spec, "dir:"))
+	case strings.HasPrefix(spec, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(spec, "s3://"), "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("blob store %q has no bucket", spec)
+		}
+		opts.Bucket, opts.Prefix = bucket, prefix
+		return NewS3(opts)
+	}
+	return nil, fmt.Errorf("unknown blob store %q: want dir:/path or s3://bucket", spec)
+}
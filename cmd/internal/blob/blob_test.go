@@ -0,0 +1,129 @@
+package blob
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a minimal S3 stand-in serving path-style object requests and
+// ListObjectsV2 for a single bucket.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "logs" {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		type content struct{ Key string }
+		var res struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []content
+		}
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				res.Contents = append(res.Contents, content{k})
+			}
+		}
+		xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	for _, key := range []string{"segments/seg-000002.log", "segments/seg-000001.log", "other"} {
+		if err := s.Put(ctx, key, strings.NewReader("data of "+key), int64(len("data of "+key))); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	rc, err := s.Get(ctx, "segments/seg-000001.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "data of segments/seg-000001.log" {
+		t.Errorf("unexpected blob %q", data)
+	}
+
+	keys, err := s.List(ctx, "segments/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"segments/seg-000001.log", "segments/seg-000002.log"}; !slices.Equal(keys, want) {
+		t.Errorf("expected keys %v, got %v", want, keys)
+	}
+
+	if err := s.Delete(ctx, "segments/seg-000001.log"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "segments/seg-000001.log"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+	if err := s.Delete(ctx, "missing"); err != nil {
+		t.Errorf("expected deleting a missing key to succeed, got %v", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	s, err := Open("dir:"+t.TempDir(), S3Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func TestS3(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	s, err := Open("s3://logs/watchlogs", S3Options{Endpoint: ts.URL, AccessKey: "key", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+
+	if _, ok := fake.objects["watchlogs/segments/seg-000002.log"]; !ok {
+		t.Error("expected objects stored under the prefix")
+	}
+
+	anonymous, _ := NewS3(S3Options{Endpoint: ts.URL, Bucket: "logs"})
+	if err := anonymous.Put(context.Background(), "x", strings.NewReader("x"), 1); err == nil {
+		t.Error("expected unsigned request to be refused")
+	}
+}
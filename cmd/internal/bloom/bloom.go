@@ -0,0 +1,105 @@
+// Package bloom implements the token filters kept next to sealed segments,
+// used to skip segments that cannot match a query without opening them.
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+// Filter is a bloom filter over a set of tokens. Test never reports a
+// token added with Add as missing, but may report a token that was never
+// added as present, at roughly the rate FalsePositiveRate estimates.
+type Filter struct {
+	bits []uint64
+	k    uint32 // hash functions per token
+	n    uint32 // tokens added
+}
+
+// New returns a filter sized for n tokens at false positive rate p.
+func New(n int, p float64) *Filter {
+	n = max(n, 1)
+	m := int(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := max(int(math.Round(float64(m)/float64(n)*math.Ln2)), 1)
+	return &Filter{bits: make([]uint64, (m+63)/64), k: uint32(k)}
+}
+
+// positions calls fn with the k bit positions of token, derived from two
+// halves of one 64-bit hash.
+func (f *Filter) positions(token string, fn func(bit uint64) bool) {
+	h := fnv.New64a()
+	h.Write([]byte(token))
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32|1
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.k); i++ {
+		if !fn((h1 + i*h2) % m) {
+			return
+		}
+	}
+}
+
+// Add adds token to the filter.
+func (f *Filter) Add(token string) {
+	f.positions(token, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+	f.n++
+}
+
+// Test reports whether token may have been added. A nil filter holds
+// every token.
+func (f *Filter) Test(token string) bool {
+	if f == nil || len(f.bits) == 0 {
+		return true
+	}
+	found := true
+	f.positions(token, func(bit uint64) bool {
+		found = f.bits[bit/64]&(1<<(bit%64)) != 0
+		return found
+	})
+	return found
+}
+
+// FalsePositiveRate estimates how often Test reports a token that was
+// never added, from the size of the filter and the tokens added.
+func (f *Filter) FalsePositiveRate() float64 {
+	if f == nil || len(f.bits) == 0 {
+		return 1
+	}
+	m := float64(len(f.bits) * 64)
+	return math.Pow(1-math.Exp(-float64(f.k)*float64(f.n)/m), float64(f.k))
+}
+
+// MarshalBinary encodes the filter as k, n and the bit words, little
+// endian.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 8+8*len(f.bits))
+	binary.LittleEndian.PutUint32(data, f.k)
+	binary.LittleEndian.PutUint32(data[4:], f.n)
+	for i, w := range f.bits {
+		binary.LittleEndian.PutUint64(data[8+8*i:], w)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes a filter written by MarshalBinary.
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	if len(data) < 16 || len(data)%8 != 0 {
+		return errors.New("bloom: invalid filter data")
+	}
+	k := binary.LittleEndian.Uint32(data)
+	if k == 0 || k > 64 {
+		return errors.New("bloom: invalid number of hash functions")
+	}
+	f.k = k
+	f.n = binary.LittleEndian.Uint32(data[4:])
+	f.bits = make([]uint64, (len(data)-8)/8)
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(data[8+8*i:])
+	}
+	return nil
+}
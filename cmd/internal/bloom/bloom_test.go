@@ -0,0 +1,48 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f := New(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add(fmt.Sprintf("token%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.Test(fmt.Sprintf("token%d", i)) {
+			t.Fatalf("expected token%d to be present", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.Test(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 0.03 {
+		t.Errorf("expected about 1%% false positives, got %.3f", rate)
+	}
+	if est := f.FalsePositiveRate(); est < 0.005 || est > 0.02 {
+		t.Errorf("expected estimated rate near 0.01, got %.4f", est)
+	}
+
+	data, _ := f.MarshalBinary()
+	var g Filter
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Test("token42") || g.FalsePositiveRate() != f.FalsePositiveRate() {
+		t.Error("expected decoded filter to match the original")
+	}
+	if err := g.UnmarshalBinary(data[:5]); err == nil {
+		t.Error("expected short data to be rejected")
+	}
+
+	var none *Filter
+	if !none.Test("anything") {
+		t.Error("expected a nil filter to hold every token")
+	}
+}
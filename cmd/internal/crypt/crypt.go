@@ -0,0 +1,124 @@
+// Package crypt encrypts segment data at rest with AES-GCM.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrUnknownKey is returned when data was sealed with a key that is not in
+// the keyring.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// Keyring holds the keys segments may be encrypted with. New data is
+// sealed with the active key; older keys stay in the ring so segments
+// written before a rotation remain readable.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// Parse reads keys written as id:base64key, separated by commas or
+// newlines. The first key is the active one. Keys must be 16, 24 or 32
+// bytes, selecting AES-128, AES-192 or AES-256.
+func Parse(s string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(field, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid key entry: want id:base64key")
+		}
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not valid base64: %v", id, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+		if k.active == "" {
+			k.active = id
+		}
+	}
+	if k.active == "" {
+		return nil, fmt.Errorf("no keys given")
+	}
+	return k, nil
+}
+
+// Load builds a keyring from the key file at path, if path is set, and
+// otherwise from keys in the Parse format, typically an environment
+// variable. It returns nil when neither is set, meaning no encryption.
+func Load(path, keys string) (*Keyring, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return Parse(string(data))
+	}
+	if keys == "" {
+		return nil, nil
+	}
+	return Parse(keys)
+}
+
+// Active returns the ID of the key new data is sealed with.
+func (k *Keyring) Active() string {
+	return k.active
+}
+
+// Has reports whether key id is in the keyring. A nil keyring holds no
+// keys.
+func (k *Keyring) Has(id string) bool {
+	if k == nil {
+		return false
+	}
+	_, ok := k.keys[id]
+	return ok
+}
+
+// Seal encrypts plaintext with key id. The result is the random nonce
+// followed by the ciphertext; the key ID is authenticated with it.
+func (k *Keyring) Seal(id string, plaintext []byte) ([]byte, error) {
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(id)), nil
+}
+
+// Open decrypts data sealed with key id.
+func (k *Keyring) Open(id string, data []byte) ([]byte, error) {
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(id))
+}
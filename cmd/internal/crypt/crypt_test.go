@@ -0,0 +1,47 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestKeyring(t *testing.T) {
+	k, err := Parse("new:" + testKey(1) + "\nold:" + testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Active() != "new" {
+		t.Errorf("expected first key active, got %s", k.Active())
+	}
+
+	sealed, err := k.Seal("old", []byte("customer 42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("customer")) {
+		t.Error("expected plaintext not to appear in sealed data")
+	}
+	plain, err := k.Open("old", sealed)
+	if err != nil || string(plain) != "customer 42" {
+		t.Fatalf("expected round trip, got %q, %v", plain, err)
+	}
+
+	// The key ID is authenticated, so data cannot be replayed under another
+	if _, err := k.Open("new", sealed); err == nil {
+		t.Error("expected opening with the wrong key to fail")
+	}
+	if _, err := k.Open("gone", sealed); err != ErrUnknownKey {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+
+	for _, bad := range []string{"", "nokey", "id:!!!", "id:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Package patterns groups log messages into templates using a Drain-style
+// fixed depth prefix tree, e.g. "user <*> failed login from <*>".
+package patterns
+
+import (
+	"strings"
+	"sync"
+)
+
+// Wildcard replaces the variable parts of a template.
+const Wildcard = "<*>"
+
+const (
+	defaultDepth       = 1   // leading tokens used to route a message through the tree
+	defaultSimilarity  = 0.5 // minimum share of equal tokens to join a template
+	defaultMaxChildren = 100 // children per node before falling back to Wildcard
+)
+
+// Template is a group of messages that only differ in wildcard positions.
+type Template struct {
+	ID     int
+	Tokens []string
+	Count  int
+}
+
+// String returns the template as a single line.
+func (t *Template) String() string {
+	return strings.Join(t.Tokens, " ")
+}
+
+type node struct {
+	children  map[string]*node
+	templates []*Template
+}
+
+// Miner assigns messages to templates. It is safe for concurrent use and
+// a nil Miner ignores every message.
+type Miner struct {
+	mu          sync.Mutex
+	depth       int
+	similarity  float64
+	maxChildren int
+	root        map[int]*node // keyed by number of tokens
+	templates   []*Template   // indexed by ID-1
+}
+
+func NewMiner() *Miner {
+	return &Miner{
+		depth:       defaultDepth,
+		similarity:  defaultSimilarity,
+		maxChildren: defaultMaxChildren,
+		root:        make(map[int]*node),
+	}
+}
+
+// Add assigns message to a template, creating one if none is similar
+// enough, and returns the template ID. Empty messages return 0.
+func (m *Miner) Add(message string) int {
+	if m == nil {
+		return 0
+	}
+	tokens := strings.Fields(message)
+	if len(tokens) == 0 {
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	leaf := m.leaf(tokens)
+
+	var best *Template
+	bestSim := -1.0
+	for _, t := range leaf.templates {
+		if sim := similarity(t.Tokens, tokens); sim > bestSim {
+			best, bestSim = t, sim
+		}
+	}
+
+	if best != nil && bestSim >= m.similarity {
+		for i, tok := range tokens {
+			if best.Tokens[i] != tok {
+				best.Tokens[i] = Wildcard
+			}
+		}
+		best.Count++
+		return best.ID
+	}
+
+	t := &Template{ID: len(m.templates) + 1, Tokens: tokens, Count: 1}
+	for i, tok := range t.Tokens {
+		if hasDigit(tok) {
+			t.Tokens[i] = Wildcard
+		}
+	}
+	m.templates = append(m.templates, t)
+	leaf.templates = append(leaf.templates, t)
+	return t.ID
+}
+
+// leaf walks the prefix tree for tokens, growing it as needed.
+func (m *Miner) leaf(tokens []string) *node {
+	n := m.root[len(tokens)]
+	if n == nil {
+		n = &node{children: make(map[string]*node)}
+		m.root[len(tokens)] = n
+	}
+
+	for i := 0; i < m.depth && i < len(tokens); i++ {
+		key := tokens[i]
+		if hasDigit(key) {
+			key = Wildcard
+		}
+		child := n.children[key]
+		if child == nil {
+			if len(n.children) >= m.maxChildren {
+				key = Wildcard
+				child = n.children[key]
+			}
+			if child == nil {
+				child = &node{children: make(map[string]*node)}
+				n.children[key] = child
+			}
+		}
+		n = child
+	}
+	return n
+}
+
+// Get returns a copy of the template with the given ID.
+func (m *Miner) Get(id int) (Template, bool) {
+	if m == nil {
+		return Template{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id < 1 || id > len(m.templates) {
+		return Template{}, false
+	}
+	t := *m.templates[id-1]
+	t.Tokens = append([]string(nil), t.Tokens...)
+	return t, true
+}
+
+// similarity is the share of positions where the template and the
+// message agree; wildcards agree with anything.
+func similarity(template, tokens []string) float64 {
+	same := 0
+	for i, tok := range template {
+		if tok == tokens[i] || tok == Wildcard {
+			same++
+		}
+	}
+	return float64(same) / float64(len(tokens))
+}
+
+func hasDigit(s string) bool {
+	return strings.ContainsAny(s, "0123456789")
+}
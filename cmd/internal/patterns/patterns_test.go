@@ -0,0 +1,36 @@
+package patterns
+
+import "testing"
+
+func TestMinerGroupsSimilarMessages(t *testing.T) {
+	m := NewMiner()
+
+	a := m.Add("user alice failed login from 10.0.0.1")
+	b := m.Add("user bob failed login from 10.0.0.7")
+	c := m.Add("cache warmed in 35ms")
+
+	if a != b {
+		t.Fatalf("expected both logins in one template, got %d and %d", a, b)
+	}
+	if a == c {
+		t.Fatalf("expected unrelated message in its own template")
+	}
+
+	tmpl, ok := m.Get(a)
+	if !ok {
+		t.Fatalf("expected template %d to exist", a)
+	}
+	if got := tmpl.String(); got != "user <*> failed login from <*>" {
+		t.Errorf("unexpected template %q", got)
+	}
+	if tmpl.Count != 2 {
+		t.Errorf("expected count 2, got %d", tmpl.Count)
+	}
+}
+
+func TestNilMiner(t *testing.T) {
+	var m *Miner
+	if id := m.Add("anything"); id != 0 {
+		t.Errorf("expected nil miner to return 0, got %d", id)
+	}
+}
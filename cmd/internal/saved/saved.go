@@ -0,0 +1,147 @@
+// Package saved stores named searches in a small JSON file.
+package saved
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for unknown saved search names.
+var ErrNotFound = errors.New("saved search not found")
+
+// Search is a named query with its filters.
+type Search struct {
+	Name      string    `json:"name"`
+	Query     string    `json:"q"`
+	Level     string    `json:"level,omitempty"`
+	Since     string    `json:"since,omitempty"` // time window, e.g. "1h"
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Store keeps saved searches in memory and persists every change to a
+// JSON file, replacing it atomically through a temporary file.
+type Store struct {
+	mu       sync.Mutex
+	path     string
+	searches map[string]Search
+}
+
+// Open loads the store at path. A missing file is an empty store.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, searches: make(map[string]Search)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Search
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, search := range list {
+		s.searches[search.Name] = search
+	}
+	return s, nil
+}
+
+// List returns every saved search ordered by name.
+func (s *Store) List() []Search {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted()
+}
+
+// Get returns the saved search called name.
+func (s *Store) Get(name string) (Search, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	search, ok := s.searches[name]
+	if !ok {
+		return Search{}, ErrNotFound
+	}
+	return search, nil
+}
+
+// Put creates or replaces a saved search.
+func (s *Store) Put(search Search) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.searches[search.Name]
+	search.UpdatedAt = time.Now()
+	s.searches[search.Name] = search
+	if err := s.persist(); err != nil {
+		if existed {
+			s.searches[search.Name] = prev
+		} else {
+			delete(s.searches, search.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the saved search called name.
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.searches[name]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.searches, name)
+	if err := s.persist(); err != nil {
+		s.searches[name] = prev
+		return err
+	}
+	return nil
+}
+
+func (s *Store) sorted() []Search {
+	list := make([]Search, 0, len(s.searches))
+	for _, search := range s.searches {
+		list = append(list, search)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// persist writes the store to a temporary file and renames it over the
+// previous one, so a crash never leaves a half written file.
+func (s *Store) persist() error {
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
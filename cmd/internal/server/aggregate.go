@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+)
+
+// maxBuckets bounds the size of a histogram response.
+const maxBuckets = 10000
+
+// Bucket is one interval of a histogram.
+type Bucket struct {
+	Start  time.Time      `json:"start"`
+	Count  int            `json:"count"`
+	Levels map[string]int `json:"levels,omitempty"`
+}
+
+// Histogram is the response of /aggregate/histogram.
+type Histogram struct {
+	Interval string    `json:"interval"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Total    int       `json:"total"`
+	Buckets  []Bucket  `json:"buckets"`
+}
+
+func (s *Server) AggregateHistogram(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt64(&s.App.Metrics.Ready) == 0 {
+		log.Printf("Received histogram request from %s but server is not ready\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("server is not ready, try again later"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		log.Printf("Received non-GET request on /aggregate/histogram: %s\n", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Printf("Received histogram request from %s with query: %s\n", r.RemoteAddr, r.URL.RawQuery)
+	query := r.URL.Query()
+
+	interval := time.Minute
+	if v := query.Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid interval", http.StatusBadRequest)
+			return
+		}
+		interval = d
+	}
+
+	now := time.Now()
+	from, err := helper.ParseTime(query.Get("from"), now.Add(-s.App.Cfg.Retention))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := helper.ParseTime(query.Get("to"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !to.After(from) {
+		http.Error(w, "to must be after from", http.StatusBadRequest)
+		return
+	}
+
+	from = from.Truncate(interval)
+	n := int(to.Sub(from)/interval) + 1
+	if n > maxBuckets {
+		http.Error(w, "too many buckets, use a larger interval", http.StatusBadRequest)
+		return
+	}
+
+	byLevel := query.Get("by") == "level"
+	hist := Histogram{Interval: interval.String(), From: from, To: to, Buckets: make([]Bucket, n)}
+	for i := range hist.Buckets {
+		hist.Buckets[i].Start = from.Add(time.Duration(i) * interval)
+		if byLevel {
+			hist.Buckets[i].Levels = make(map[string]int)
+		}
+	}
+
+	q, err := helper.ParseQuery(query.Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.App.Mu.Lock()
+	for _, segment := range s.App.Segments {
+		if r.Context().Err() != nil {
+			break
+		}
+		if !overlaps(segment, from, to) {
+			continue
+		}
+		it := q.Match(r.Context(), segment, nil).Iterator()
+		for id, ok := it.Next(); ok; id, ok = it.Next() {
+			ts := segment.Time(id)
+			if ts.Before(from) || ts.After(to) {
+				continue
+			}
+			b := &hist.Buckets[int(ts.Sub(from)/interval)]
+			b.Count++
+			hist.Total++
+			if byLevel {
+				b.Levels[strings.ToLower(segment.Level(id))]++
+			}
+		}
+	}
+	s.App.Mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hist)
+}
+
+// overlaps reports whether segment may hold entries between from and to.
+func overlaps(segment *app.Segment, from, to time.Time) bool {
+	if segment.Len() == 0 {
+		return false
+	}
+	return !segment.MaxTime.Before(from) && !segment.MinTime.After(to)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+)
+
+func TestAggregateHistogram(t *testing.T) {
+	a := &app.App{
+		Cfg: app.Config{MaxResults: 1, Retention: time.Hour},
+		CurrentSegment: &app.Segment{
+			Index: make(map[string]*app.PostingList),
+		},
+	}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	a.CurrentSegment.Logs = []app.LogEntry{
+		{Timestamp: base.Add(10 * time.Second), Level: "ERROR", Message: "db timeout"},
+		{Timestamp: base.Add(20 * time.Second), Level: "INFO", Message: "db timeout retried"},
+		{Timestamp: base.Add(30 * time.Second), Level: "INFO", Message: "request served"},
+		{Timestamp: base.Add(130 * time.Second), Level: "ERROR", Message: "db timeout"},
+	}
+	a.Segments = append(a.Segments, a.CurrentSegment)
+	for i, log := range a.CurrentSegment.Logs {
+		helper.IndexEntry(a.CurrentSegment, i, log, 0)
+	}
+
+	from := base.Format(time.RFC3339)
+	to := base.Add(3 * time.Minute).Format(time.RFC3339)
+	request := httptest.NewRequest(http.MethodGet, "/aggregate/histogram?q=db+timeout&interval=1m&by=level&from="+from+"&to="+to, nil)
+	response := httptest.NewRecorder()
+	srv.AggregateHistogram(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status 200 OK, got %d", response.Code)
+	}
+
+	var hist Histogram
+	if err := json.NewDecoder(response.Body).Decode(&hist); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if hist.Total != 3 {
+		t.Errorf("expected total 3 despite MaxResults, got %d", hist.Total)
+	}
+	if len(hist.Buckets) != 4 {
+		t.Fatalf("expected 4 buckets, got %d", len(hist.Buckets))
+	}
+	counts := []int{2, 0, 1, 0}
+	for i, b := range hist.Buckets {
+		if b.Count != counts[i] {
+			t.Errorf("bucket %d: expected count %d, got %d", i, counts[i], b.Count)
+		}
+	}
+	if hist.Buckets[0].Levels["error"] != 1 || hist.Buckets[0].Levels["info"] != 1 {
+		t.Errorf("expected level split in first bucket, got %v", hist.Buckets[0].Levels)
+	}
+
+	t.Run("invalid interval", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/aggregate/histogram?interval=soon", nil)
+		response := httptest.NewRecorder()
+		srv.AggregateHistogram(response, request)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 Bad Request, got %d", response.Code)
+		}
+	})
+}
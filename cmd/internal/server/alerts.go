@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"watchlogs/cmd/internal/alert"
+)
+
+// AlertRules serves the alerting API:
+//
+//	GET    /alerts         list rules with their state
+//	POST   /alerts         create or replace a rule from the JSON body
+//	GET    /alerts/{name}  fetch one rule and its state
+//	PUT    /alerts/{name}  create or replace a rule
+//	DELETE /alerts/{name}  delete a rule
+func (s *Server) AlertRules(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt64(&s.App.Metrics.Ready) == 0 {
+		log.Printf("Received alerts request from %s but server is not ready\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("server is not ready, try again later"))
+		return
+	}
+	if s.Alerts == nil {
+		http.Error(w, "alerting is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("Received %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/alerts"), "/")
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.Alerts.Rules())
+
+	case name == "" && r.Method == http.MethodPost, name != "" && r.Method == http.MethodPut:
+		var rule alert.Rule
+		if json.NewDecoder(r.Body).Decode(&rule) != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		if name != "" {
+			rule.Name = name
+		}
+		if _, err := rule.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Alerts.Put(rule); err != nil {
+			log.Printf("Failed to store alert rule %s: %v\n", rule.Name, err)
+			http.Error(w, "failed to store alert rule", http.StatusInternalServerError)
+			return
+		}
+		status, _ := s.Alerts.Get(rule.Name)
+		writeJSON(w, http.StatusOK, status)
+
+	case name != "" && r.Method == http.MethodGet:
+		status, err := s.Alerts.Get(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+
+	case name != "" && r.Method == http.MethodDelete:
+		err := s.Alerts.Delete(name)
+		if errors.Is(err, alert.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to delete alert rule %s: %v\n", name, err)
+			http.Error(w, "failed to delete alert rule", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import "watchlogs/cmd/internal/app"
+
+// maxContext bounds the number of context lines on each side of a hit.
+const maxContext = 100
+
+// attachContext fills Before and After of every hit with the entries
+// written just before and after it, crossing into neighbouring segments
+// when the hit is near a segment boundary. The caller must hold App.Mu.
+func (s *Server) attachContext(hits []Hit, before, after int) {
+	position := make(map[int]int, len(s.App.Segments))
+	for i, segment := range s.App.Segments {
+		position[segment.Id] = i
+	}
+
+	for i := range hits {
+		seg, ok := position[hits[i].Segment]
+		if !ok {
+			continue
+		}
+		hits[i].Before = s.entriesBefore(seg, hits[i].ID, before)
+		hits[i].After = s.entriesAfter(seg, hits[i].ID, after)
+	}
+}
+
+// entriesBefore returns up to n entries preceding id in write order.
+func (s *Server) entriesBefore(seg, id, n int) []app.LogEntry {
+	var out []app.LogEntry
+	for n > 0 && seg >= 0 {
+		start := max(id-n, 0)
+		out = append(entryRange(s.App.Segments[seg], start, id), out...)
+		n -= id - start
+
+		seg--
+		if seg >= 0 {
+			id = s.App.Segments[seg].Len()
+		}
+	}
+	return out
+}
+
+// entriesAfter returns up to n entries following id in write order.
+func (s *Server) entriesAfter(seg, id, n int) []app.LogEntry {
+	var out []app.LogEntry
+	from := id + 1
+	for n > 0 && seg < len(s.App.Segments) {
+		segment := s.App.Segments[seg]
+		from = min(from, segment.Len())
+		end := min(from+n, segment.Len())
+		out = append(out, entryRange(segment, from, end)...)
+		n -= end - from
+
+		seg++
+		from = 0
+	}
+	return out
+}
+
+// entryRange returns the entries of segment with IDs from start to end,
+// end being exclusive.
+func entryRange(segment *app.Segment, start, end int) []app.LogEntry {
+	out := make([]app.LogEntry, 0, end-start)
+	for id := start; id < end; id++ {
+		out = append(out, segment.Entry(id))
+	}
+	return out
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+)
+
+// exportFlushEvery is how many entries are written between flushes.
+const exportFlushEvery = 500
+
+// exportWriter encodes entries in one of the export formats.
+type exportWriter interface {
+	Write(e app.LogEntry) error
+	Flush()
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (n ndjsonWriter) Write(e app.LogEntry) error { return n.enc.Encode(e) }
+func (n ndjsonWriter) Flush()                     {}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c csvWriter) Write(e app.LogEntry) error {
+	fields := ""
+	if len(e.Fields) > 0 {
+		data, _ := json.Marshal(e.Fields)
+		fields = string(data)
+	}
+	return c.w.Write([]string{e.Timestamp.Format(time.RFC3339Nano), e.Level, e.Message, fields})
+}
+
+func (c csvWriter) Flush() { c.w.Flush() }
+
+// Export streams every entry matching the query, oldest first, as NDJSON
+// or CSV. Unlike /search it is not capped by MaxResults. Segments that are
+// no longer in memory are read from disk, and App.Mu is only held while
+// matching one in-memory segment at a time. The in-memory segments are
+// held from the start, so compaction, retention or eviction running
+// meanwhile cannot empty them before they are exported.
+func (s *Server) Export(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt64(&s.App.Metrics.Ready) == 0 {
+		log.Printf("Received export request from %s but server is not ready\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("server is not ready, try again later"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		log.Printf("Received non-GET request on /export: %s\n", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Printf("Received export request from %s with query: %s\n", r.RemoteAddr, r.URL.RawQuery)
+
+	q, err := helper.ParseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := filter{
+		since: helper.ParseSince(r.URL.Query().Get("since")),
+		level: r.URL.Query().Get("level"),
+	}
+
+	var out exportWriter
+	switch r.URL.Query().Get("format") {
+	case "", "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		out = ndjsonWriter{enc: json.NewEncoder(w)}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"timestamp", "level", "message", "fields"})
+		out = csvWriter{w: cw}
+	default:
+		http.Error(w, "format must be ndjson or csv", http.StatusBadRequest)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	ctx := r.Context()
+	written := 0
+	flush := func() {
+		out.Flush()
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	emit := func(entries []app.LogEntry) bool {
+		for _, e := range entries {
+			if err := out.Write(e); err != nil {
+				log.Printf("Export to %s failed after %d entries: %v\n", r.RemoteAddr, written, err)
+				return false
+			}
+			if written++; written%exportFlushEvery == 0 {
+				flush()
+			}
+		}
+		flush()
+		return ctx.Err() == nil
+	}
+
+	hot, release := s.holdSegments()
+	defer release()
+
+	// Sealed segments older than the in-memory ones are only on disk or in
+	// the blob store
+	below := -1
+	if len(hot) > 0 {
+		below = hot[0].Id
+	}
+	for _, id := range helper.ColdSegmentIDs(s.App, below) {
+		seg := s.readCold(ctx, q, id, nil)
+		if seg == nil {
+			continue
+		}
+		if !emit(matchedEntries(ctx, seg, q, f)) {
+			return
+		}
+	}
+
+	for _, seg := range hot {
+		s.App.Mu.Lock()
+		entries := matchedEntries(ctx, seg, q, f)
+		s.App.Mu.Unlock()
+
+		if !emit(entries) {
+			return
+		}
+	}
+	log.Printf("Exported %d entries to %s\n", written, r.RemoteAddr)
+}
+
+// matchedEntries copies the entries of segment that match q and f.
+func matchedEntries(ctx context.Context, segment *app.Segment, q *helper.Query, f filter) []app.LogEntry {
+	var entries []app.LogEntry
+	for _, id := range segmentMatches(ctx, segment, q, f, nil) {
+		if f.match(segment, id) {
+			entries = append(entries, segment.Entry(id))
+		}
+	}
+	return entries
+}
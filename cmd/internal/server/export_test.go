@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/bloom"
+)
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	// Segment 1 is only on disk, segment 2 is in memory
+	cold, err := os.Create(helper.SegmentPath(dir, 1))
+	if err != nil {
+		t.Fatalf("failed to create segment: %v", err)
+	}
+	for _, msg := range []string{"payment failed early", "cache warmed"} {
+		data, _ := json.Marshal(app.LogEntry{Timestamp: now.Add(-time.Hour), Level: "ERROR", Message: msg})
+		cold.Write(append(data, '\n'))
+	}
+	cold.Close()
+
+	a := &app.App{Cfg: app.Config{MaxResults: 1, DataPath: dir, Retention: 24 * time.Hour}}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	hot := &app.Segment{Id: 2, Index: make(map[string]*app.PostingList)}
+	for i, msg := range []string{"payment failed late", "payment ok, again"} {
+		e := app.LogEntry{Timestamp: now, Level: "ERROR", Message: msg}
+		hot.Logs = append(hot.Logs, e)
+		helper.IndexEntry(hot, i, e, 0)
+	}
+	a.Segments = []*app.Segment{hot}
+	a.CurrentSegment = hot
+
+	t.Run("ndjson", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/export?q=payment", nil)
+		response := httptest.NewRecorder()
+		srv.Export(response, request)
+
+		if ct := response.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("unexpected Content-Type %q", ct)
+		}
+		var messages []string
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			var e app.LogEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+			}
+			messages = append(messages, e.Message)
+		}
+		want := []string{"payment failed early", "payment failed late", "payment ok, again"}
+		if len(messages) != len(want) {
+			t.Fatalf("expected %v, got %v", want, messages)
+		}
+		for i := range want {
+			if messages[i] != want[i] {
+				t.Errorf("line %d: expected %q, got %q", i, want[i], messages[i])
+			}
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/export?q=ok&format=csv", nil)
+		response := httptest.NewRecorder()
+		srv.Export(response, request)
+
+		records, err := csv.NewReader(response.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("invalid csv: %v", err)
+		}
+		if len(records) != 2 || records[0][0] != "timestamp" || records[1][2] != "payment ok, again" {
+			t.Errorf("unexpected csv records %v", records)
+		}
+	})
+
+	t.Run("bloom", func(t *testing.T) {
+		// A filter without "payment" rules segment 1 out without reading it
+		f := bloom.New(2, 0.01)
+		f.Add("cache")
+		f.Add("warmed")
+		data, _ := f.MarshalBinary()
+		if err := helper.WriteSidecar(helper.BloomPath(dir, 1), data, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		request := httptest.NewRequest(http.MethodGet, "/export?q=payment", nil)
+		response := httptest.NewRecorder()
+		srv.Export(response, request)
+
+		if lines := bytes.Count(response.Body.Bytes(), []byte("\n")); lines != 2 {
+			t.Errorf("expected only the 2 in-memory matches, got %d lines", lines)
+		}
+	})
+}
+
+// compactOnWrite runs compaction while the export it serves is between
+// segments.
+type compactOnWrite struct {
+	*httptest.ResponseRecorder
+	compact func()
+}
+
+func (w *compactOnWrite) Write(p []byte) (int, error) {
+	if w.compact != nil {
+		w.compact()
+		w.compact = nil
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestExportDuringCompaction(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	a := &app.App{Cfg: app.Config{DataPath: dir, MaxSegSize: 4096, Retention: 24 * time.Hour}}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	// Segments 1-3 are sealed and mapped, small enough to be merged
+	for id := 1; id <= 3; id++ {
+		data, _ := json.Marshal(app.LogEntry{Timestamp: now, Level: "INFO", Message: "payment " + string(rune('a'+id))})
+		if err := os.WriteFile(helper.SegmentPath(dir, id), append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+		seg := &app.Segment{Id: id}
+		if err := helper.MapSegment(seg, helper.SegmentPath(dir, id), nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		a.Segments = append(a.Segments, seg)
+	}
+	current, err := helper.OpenSegment(4, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.File.Close()
+	a.Segments = append(a.Segments, current)
+	a.CurrentSegment = current
+	sources := a.Segments[:3]
+
+	response := &compactOnWrite{ResponseRecorder: httptest.NewRecorder()}
+	response.compact = func() { helper.Compact(a, now) }
+	srv.Export(response, httptest.NewRequest(http.MethodGet, "/export?q=payment", nil))
+
+	if len(a.Segments) != 2 {
+		t.Fatalf("expected segments 1-3 compacted during the export, got %d segments", len(a.Segments))
+	}
+	if lines := bytes.Count(response.Body.Bytes(), []byte("\n")); lines != 3 {
+		t.Errorf("expected all 3 entries exported, got %d: %s", lines, response.Body.String())
+	}
+	for _, seg := range sources[1:] {
+		if seg.Len() != 0 {
+			t.Errorf("expected compacted segment %d released once the export finished", seg.Id)
+		}
+	}
+}
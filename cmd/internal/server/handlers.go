@@ -1,10 +1,13 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -30,12 +33,21 @@ func (s *Server) Ingest(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Received ingest request from %s\n", r.RemoteAddr)
 
+	// Refuse entries before the disk fills up rather than dropping them
+	if atomic.LoadInt64(&s.App.Metrics.DiskLow) == 1 {
+		log.Printf("Disk is low, rejecting request from %s\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write([]byte("insufficient storage, try again later"))
+		return
+	}
+
 	// Increment total ingested logs metric
 	atomic.AddInt64(&s.App.Metrics.TotalIngested, 1)
 
 	var req struct {
-		Level   string `json:"level"`
-		Message string `json:"message"`
+		Level   string            `json:"level"`
+		Message string            `json:"message"`
+		Fields  map[string]string `json:"fields"`
 	}
 
 	if json.NewDecoder(r.Body).Decode(&req) != nil {
@@ -48,6 +60,7 @@ func (s *Server) Ingest(w http.ResponseWriter, r *http.Request) {
 		Timestamp: time.Now(),
 		Level:     req.Level,
 		Message:   req.Message,
+		Fields:    req.Fields,
 	}
 
 	select {
@@ -77,49 +90,143 @@ func (s *Server) Search(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Received search request from %s with query: %s\n", r.RemoteAddr, r.URL.RawQuery)
 	atomic.AddInt64(&s.App.Metrics.TotalSearched, 1)
 
-	q := r.URL.Query().Get("q")
+	params := r.URL.Query()
+	if name := params.Get("saved"); name != "" {
+		var err error
+		params, err = s.withSaved(name, params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	q, err := helper.ParseQuery(params.Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := filter{
+		since: helper.ParseSince(params.Get("since")),
+		level: params.Get("level"),
+	}
+	if v := params.Get("pattern"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			http.Error(w, "invalid pattern id", http.StatusBadRequest)
+			return
+		}
+		f.pattern = id
+	}
+
+	var ex *Explain
+	if params.Get("explain") == "true" {
+		ex = newExplain(q)
+	}
+	started := time.Now()
 
-	tokens := helper.Tokenize(q)
-	if len(tokens) == 0 {
+	// Count mode returns totals and facets instead of entries
+	if params.Get("count") == "true" {
+		var facets []string
+		if v := params.Get("facets"); v != "" {
+			facets = strings.Split(v, ",")
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		res := s.count(ctx, q, f, facets, ex)
+		if ex != nil {
+			ex.Duration = time.Since(started).String()
+		}
+
+		if r.Context().Err() != nil {
+			log.Printf("Search request from %s was cancelled\n", r.RemoteAddr)
+			return
+		}
+		res.TimedOut = ctx.Err() == context.DeadlineExceeded
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	if q == nil && f.pattern == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("query cannot be empty"))
 		return
 	}
 
-	s.App.Mu.Lock()
-	defer s.App.Mu.Unlock()
-
-	var results []app.LogEntry
-	var ids []int
-	sinceTime := helper.ParseSince(r.URL.Query().Get("since"))
-
-	for seg := len(s.App.Segments) - 1; seg >= 0 && len(ids) < s.App.Cfg.MaxResults; seg-- {
-		segment := s.App.Segments[seg]
-		for i := range tokens {
-			if len(ids) == 0 {
-				ids = segment.Index[tokens[i]]
-			} else {
-				ids = helper.Intersect(ids, segment.Index[tokens[i]])
-			}
-		}
+	order := params.Get("sort")
+	switch order {
+	case "":
+		order = SortTimeDesc
+	case SortTimeDesc, SortTimeAsc, SortRelevance:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("sort must be one of time_desc, time_asc, relevance"))
+		return
+	}
 
-		for i := len(ids) - 1; i >= 0 && len(results) < s.App.Cfg.MaxResults; i-- {
-			e := segment.Logs[ids[i]]
-			if !sinceTime.IsZero() && e.Timestamp.Before(sinceTime) {
-				continue
+	var before, after int
+	for name, n := range map[string]*int{"before": &before, "after": &after} {
+		if v := params.Get(name); v != "" {
+			c, err := strconv.Atoi(v)
+			if err != nil || c < 0 || c > maxContext {
+				http.Error(w, fmt.Sprintf("%s must be between 0 and %d", name, maxContext), http.StatusBadRequest)
+				return
 			}
-			results = append(results, e)
+			*n = c
 		}
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	results := s.search(ctx, q, f, order, ex)
+	if before > 0 || after > 0 {
+		s.App.Mu.Lock()
+		s.attachContext(results, before, after)
+		s.App.Mu.Unlock()
+	}
+
+	if r.Context().Err() != nil {
+		log.Printf("Search request from %s was cancelled\n", r.RemoteAddr)
+		return
+	}
+	timedOut := ctx.Err() == context.DeadlineExceeded
+	if timedOut {
+		log.Printf("Search request from %s timed out, returning %d partial results\n", r.RemoteAddr, len(results))
+		w.Header().Set("X-Timed-Out", "true")
+	}
 
-		// reset ids for next segment
-		ids = nil
+	if params.Get("highlight") == "true" {
+		for i := range results {
+			results[i].Highlights = helper.Highlight(results[i].Message, q.Tokens())
+		}
 	}
 
 	// Return results as JSON
 	w.Header().Set("Content-Type", "application/json")
+	if ex != nil {
+		ex.Duration = time.Since(started).String()
+		json.NewEncoder(w).Encode(struct {
+			Hits     []Hit    `json:"hits"`
+			TimedOut bool     `json:"timed_out,omitempty"`
+			Explain  *Explain `json:"explain"`
+		}{results, timedOut, ex})
+		return
+	}
 	json.NewEncoder(w).Encode(results)
 }
 
+// queryContext bounds a query by the request context and MaxQueryTime.
+func (s *Server) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.App.Cfg.MaxQueryTime <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), s.App.Cfg.MaxQueryTime)
+}
+
 func (s *Server) Metrics(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		log.Printf("Received non-GET request on /metrics: %s\n", r.Method)
@@ -131,11 +238,11 @@ func (s *Server) Metrics(w http.ResponseWriter, r *http.Request) {
 	s.App.Mu.Lock()
 	var logCount = 0
 	for _, seg := range s.App.Segments {
-		logCount += len(seg.Logs)
+		logCount += seg.Len()
 	}
 	var tokenCount = 0
 	for _, ids := range s.App.CurrentSegment.Index {
-		tokenCount += len(ids)
+		tokenCount += ids.Len()
 	}
 	s.App.Mu.Unlock()
 
@@ -146,6 +253,15 @@ func (s *Server) Metrics(w http.ResponseWriter, r *http.Request) {
 		tokenCount,
 		atomic.LoadInt64(&s.App.Metrics.TotalIngested),
 		atomic.LoadInt64(&s.App.Metrics.TotalSearched))
+	fmt.Fprintf(w, "dropped %d\nwrite_degraded %d\n",
+		atomic.LoadInt64(&s.App.Metrics.Dropped),
+		atomic.LoadInt64(&s.App.Metrics.Degraded))
+	fmt.Fprintf(w,
+		"disk_used_bytes %d\ndisk_quota_bytes %d\ndisk_free_bytes %d\ndisk_low %d\n",
+		atomic.LoadInt64(&s.App.Metrics.DiskUsed),
+		s.App.Cfg.DiskQuota,
+		atomic.LoadInt64(&s.App.Metrics.DiskFree),
+		atomic.LoadInt64(&s.App.Metrics.DiskLow))
 }
 
 func (s *Server) Health(w http.ResponseWriter, r *http.Request) {
@@ -167,6 +283,13 @@ func (s *Server) Ready(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if atomic.LoadInt64(&s.App.Metrics.Ready) == 1 && atomic.LoadInt64(&s.App.Metrics.Degraded) == 1 {
+		log.Printf("Received ready check request from %s - DEGRADED\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("degraded: writes to disk are failing"))
+		return
+	}
+
 	if atomic.LoadInt64(&s.App.Metrics.Ready) == 1 {
 		log.Printf("Received ready check request from %s - READY\n", r.RemoteAddr)
 		w.WriteHeader(http.StatusOK)
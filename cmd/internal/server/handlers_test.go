@@ -6,11 +6,17 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"sync/atomic"
 	"testing"
+	"time"
 	"watchlogs/cmd/helper"
 	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/blob"
+	"watchlogs/cmd/internal/bloom"
 )
 
 func TestIngest(t *testing.T) {
@@ -29,7 +35,7 @@ func TestIngest(t *testing.T) {
 			Cfg:   cfg,
 			LogCh: make(chan app.LogEntry, cfg.ChannelSize),
 			CurrentSegment: &app.Segment{
-				Index: make(map[string][]int),
+				Index: make(map[string]*app.PostingList),
 			},
 		}
 
@@ -62,7 +68,7 @@ func TestIngest(t *testing.T) {
 	t.Run("invalid json payload", func(t *testing.T) {
 		a := &app.App{
 			CurrentSegment: &app.Segment{
-				Index: make(map[string][]int),
+				Index: make(map[string]*app.PostingList),
 			},
 		}
 		srv := New(a)
@@ -79,7 +85,7 @@ func TestIngest(t *testing.T) {
 	t.Run("ingest with non-POST request", func(t *testing.T) {
 		a := &app.App{
 			CurrentSegment: &app.Segment{
-				Index: make(map[string][]int),
+				Index: make(map[string]*app.PostingList),
 			},
 		}
 		srv := New(a)
@@ -93,6 +99,25 @@ func TestIngest(t *testing.T) {
 			t.Errorf("expected status 405 Method Not Allowed, got %d", response.Code)
 		}
 	})
+	t.Run("ingest when disk is low", func(t *testing.T) {
+		a := &app.App{LogCh: make(chan app.LogEntry, 1)}
+		srv := New(a)
+		atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+		atomic.StoreInt64(&srv.App.Metrics.DiskLow, 1)
+
+		body := []byte(`{"level": "INFO", "message": "disk is full"}`)
+		req := httptest.NewRequest(http.MethodPost, "/ingest", bytes.NewReader(body))
+		res := httptest.NewRecorder()
+
+		srv.Ingest(res, req)
+
+		if res.Code != http.StatusInsufficientStorage {
+			t.Fatalf("expected status 507 Insufficient Storage, got %d", res.Code)
+		}
+		if len(a.LogCh) != 0 {
+			t.Error("expected entry not to be queued")
+		}
+	})
 	t.Run("ingest when log channel is full", func(t *testing.T) {
 		cfg := helper.LoadConfig()
 		cfg.ChannelSize = 1 // Set channel size to 1 for testing
@@ -101,7 +126,7 @@ func TestIngest(t *testing.T) {
 			Cfg:   cfg,
 			LogCh: tempChannel,
 			CurrentSegment: &app.Segment{
-				Index: make(map[string][]int),
+				Index: make(map[string]*app.PostingList),
 			},
 		}
 		srv := New(a)
@@ -134,7 +159,7 @@ func TestIngest(t *testing.T) {
 func TestSearch(t *testing.T) {
 	a := &app.App{
 		CurrentSegment: &app.Segment{
-			Index: make(map[string][]int),
+			Index: make(map[string]*app.PostingList),
 		},
 	}
 	srv := New(a)
@@ -155,9 +180,7 @@ func TestSearch(t *testing.T) {
 
 	a.Segments = append(a.Segments, a.CurrentSegment)
 	for i, log := range a.CurrentSegment.Logs {
-		for _, token := range helper.Tokenize(log.Message) {
-			a.CurrentSegment.Index[token] = append(a.CurrentSegment.Index[token], i)
-		}
+		helper.IndexEntry(a.CurrentSegment, i, log, 0)
 	}
 
 	t.Run("search returns logs as JSON", func(t *testing.T) {
@@ -227,3 +250,458 @@ func TestSearch(t *testing.T) {
 		}
 	})
 }
+
+func TestSearchSort(t *testing.T) {
+	a := &app.App{
+		Cfg: app.Config{MaxResults: 10},
+		CurrentSegment: &app.Segment{
+			Index: make(map[string]*app.PostingList),
+		},
+	}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	now := time.Now()
+	a.CurrentSegment.Logs = []app.LogEntry{
+		{Timestamp: now.Add(-3 * time.Minute), Level: "ERROR", Message: "payment failed payment gateway timeout"},
+		{Timestamp: now.Add(-2 * time.Minute), Level: "INFO", Message: "user logged in after a very long and winding payment flow"},
+		{Timestamp: now.Add(-1 * time.Minute), Level: "INFO", Message: "cache warmed"},
+	}
+	a.Segments = append(a.Segments, a.CurrentSegment)
+	for i, log := range a.CurrentSegment.Logs {
+		helper.IndexEntry(a.CurrentSegment, i, log, 0)
+	}
+
+	search := func(t *testing.T, query string) []Hit {
+		request := httptest.NewRequest(http.MethodGet, "/search?"+query, nil)
+		response := httptest.NewRecorder()
+		srv.Search(response, request)
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected status 200 OK, got %d", response.Code)
+		}
+		var hits []Hit
+		if err := json.NewDecoder(response.Body).Decode(&hits); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return hits
+	}
+
+	t.Run("default is newest first", func(t *testing.T) {
+		hits := search(t, "q=payment")
+		if len(hits) != 2 || hits[0].Level != "INFO" || hits[0].Score != 0 {
+			t.Errorf("expected newest unscored hit first, got %+v", hits)
+		}
+	})
+
+	t.Run("time_asc is oldest first", func(t *testing.T) {
+		hits := search(t, "q=payment&sort=time_asc")
+		if len(hits) != 2 || hits[0].Level != "ERROR" {
+			t.Errorf("expected oldest hit first, got %+v", hits)
+		}
+	})
+
+	t.Run("relevance ranks by bm25", func(t *testing.T) {
+		hits := search(t, "q=payment&sort=relevance")
+		if len(hits) != 2 {
+			t.Fatalf("expected 2 hits, got %d", len(hits))
+		}
+		if hits[0].Level != "ERROR" || hits[0].Score <= hits[1].Score || hits[1].Score <= 0 {
+			t.Errorf("expected short repeated match ranked first with scores, got %+v", hits)
+		}
+	})
+
+	t.Run("highlight returns matched term offsets", func(t *testing.T) {
+		hits := search(t, "q=Payment+timeout&highlight=true")
+		if len(hits) != 1 {
+			t.Fatalf("expected 1 hit, got %d", len(hits))
+		}
+		want := []helper.Span{
+			{Token: "payment", Start: 0, End: 7},
+			{Token: "payment", Start: 15, End: 22},
+			{Token: "timeout", Start: 31, End: 38},
+		}
+		if !slices.Equal(hits[0].Highlights, want) {
+			t.Errorf("expected highlights %v, got %v", want, hits[0].Highlights)
+		}
+	})
+
+	t.Run("unknown sort is rejected", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/search?q=payment&sort=size", nil)
+		response := httptest.NewRecorder()
+		srv.Search(response, request)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 Bad Request, got %d", response.Code)
+		}
+	})
+}
+
+func TestSearchCount(t *testing.T) {
+	a := &app.App{
+		Cfg: app.Config{MaxResults: 1},
+		CurrentSegment: &app.Segment{
+			Index: make(map[string]*app.PostingList),
+		},
+	}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	now := time.Now()
+	a.CurrentSegment.Logs = []app.LogEntry{
+		{Timestamp: now, Level: "ERROR", Message: "payment declined", Fields: map[string]string{"service": "checkout"}},
+		{Timestamp: now, Level: "error", Message: "payment timeout", Fields: map[string]string{"service": "billing"}},
+		{Timestamp: now, Level: "INFO", Message: "payment accepted", Fields: map[string]string{"service": "checkout"}},
+		{Timestamp: now.Add(-2 * time.Hour), Level: "ERROR", Message: "payment declined"},
+	}
+	a.Segments = append(a.Segments, a.CurrentSegment)
+	for i, log := range a.CurrentSegment.Logs {
+		helper.IndexEntry(a.CurrentSegment, i, log, 0)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/search?q=payment&level=error&since=1h&count=true&facets=level,service", nil)
+	response := httptest.NewRecorder()
+	srv.Search(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status 200 OK, got %d", response.Code)
+	}
+
+	var res CountResult
+	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if res.Count != 2 || res.Approximate {
+		t.Errorf("expected exact count 2 beyond MaxResults, got %+v", res)
+	}
+	if res.Facets["level"]["error"] != 2 {
+		t.Errorf("expected level facet error=2, got %v", res.Facets["level"])
+	}
+	if res.Facets["service"]["checkout"] != 1 || res.Facets["service"]["billing"] != 1 {
+		t.Errorf("expected service facet split, got %v", res.Facets["service"])
+	}
+}
+
+func TestSearchColdSegments(t *testing.T) {
+	dir := t.TempDir()
+	store, err := blob.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	writeSegment := func(id int, entries ...app.LogEntry) {
+		f, err := os.Create(helper.SegmentPath(dir, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			data, _ := json.Marshal(e)
+			f.Write(append(data, '\n'))
+		}
+		f.Close()
+	}
+
+	// Segment 1 is moved to the blob store, segment 2 stays on disk and
+	// segment 3 is in memory
+	writeSegment(1, app.LogEntry{Timestamp: now.Add(-3 * time.Hour), Level: "ERROR", Message: "payment failed remote"})
+	os.Chtimes(helper.SegmentPath(dir, 1), now.Add(-3*time.Hour), now.Add(-3*time.Hour))
+	writeSegment(2,
+		app.LogEntry{Timestamp: now.Add(-2 * time.Hour), Level: "ERROR", Message: "payment failed on disk"},
+		app.LogEntry{Timestamp: now.Add(-2 * time.Hour), Level: "INFO", Message: "cache warmed"},
+	)
+	hot := &app.Segment{Id: 3, Index: make(map[string]*app.PostingList)}
+	e := app.LogEntry{Timestamp: now.Add(-time.Hour), Level: "ERROR", Message: "payment failed in memory"}
+	hot.Logs = append(hot.Logs, e)
+	helper.IndexEntry(hot, 0, e, 0)
+
+	a := &app.App{
+		Cfg:            app.Config{MaxResults: 10, DataPath: dir, Retention: 24 * time.Hour, WarmAge: time.Hour},
+		Blobs:          store,
+		Segments:       []*app.Segment{hot},
+		CurrentSegment: hot,
+	}
+	helper.RefreshManifest(dir, 3, nil)
+	helper.Tier(a, now)
+	if ids, _ := helper.ListSegments(dir); !slices.Equal(ids, []int{2}) {
+		t.Fatalf("expected only segment 2 left on disk, got %v", ids)
+	}
+
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+	search := func(query string) *httptest.ResponseRecorder {
+		t.Helper()
+		response := httptest.NewRecorder()
+		srv.Search(response, httptest.NewRequest(http.MethodGet, "/search?"+query, nil))
+		if response.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200 OK, got %d", query, response.Code)
+		}
+		return response
+	}
+
+	for query, want := range map[string][]string{
+		"q=payment":                {"payment failed in memory", "payment failed on disk", "payment failed remote"},
+		"q=payment&sort=time_asc":  {"payment failed remote", "payment failed on disk", "payment failed in memory"},
+		"q=payment&sort=relevance": {"payment failed in memory", "payment failed on disk", "payment failed remote"},
+	} {
+		var hits []Hit
+		if err := json.NewDecoder(search(query).Body).Decode(&hits); err != nil {
+			t.Fatalf("%s: failed to decode response: %v", query, err)
+		}
+		var messages []string
+		for _, h := range hits {
+			messages = append(messages, h.Message)
+		}
+		if query == "q=payment&sort=relevance" {
+			slices.Sort(messages)
+			slices.Sort(want)
+		}
+		if !slices.Equal(messages, want) {
+			t.Errorf("%s: expected %v, got %v", query, want, messages)
+		}
+	}
+
+	var res CountResult
+	if err := json.NewDecoder(search("q=payment&count=true&facets=level").Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode count: %v", err)
+	}
+	if res.Count != 3 || res.Facets["level"]["error"] != 3 {
+		t.Errorf("expected 3 errors counted across tiers, got %+v", res)
+	}
+
+	params := url.Values{
+		"query": {"count_over_time(payment)"},
+		"start": {strconv.FormatInt(now.Add(-3*time.Hour).Unix(), 10)},
+		"end":   {strconv.FormatInt(now.Unix(), 10)},
+		"step":  {"1h"},
+	}
+	response := httptest.NewRecorder()
+	srv.QueryRange(response, httptest.NewRequest(http.MethodGet, "/query_range?"+params.Encode(), nil))
+	var series promResponse
+	if err := json.NewDecoder(response.Body).Decode(&series); err != nil || series.Data == nil || len(series.Data.Result) != 1 {
+		t.Fatalf("unexpected query_range response %s: %v", response.Body, err)
+	}
+	var values []string
+	for _, v := range series.Data.Result[0].Values {
+		values = append(values, v[1].(string))
+	}
+	if !slices.Equal(values, []string{"1", "1", "1", "0"}) {
+		t.Errorf("expected one match per hour across tiers, got %v", values)
+	}
+}
+
+func TestSearchContext(t *testing.T) {
+	a := &app.App{Cfg: app.Config{MaxResults: 10}}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	messages := [][]string{
+		{"boot", "connect db", "db ready"},
+		{"request one", "panic in handler", "request two", "request three"},
+	}
+	for i, msgs := range messages {
+		seg := &app.Segment{Id: i + 1, Index: make(map[string]*app.PostingList)}
+		for id, msg := range msgs {
+			e := app.LogEntry{Timestamp: time.Now(), Level: "INFO", Message: msg}
+			seg.Logs = append(seg.Logs, e)
+			helper.IndexEntry(seg, id, e, 0)
+		}
+		a.Segments = append(a.Segments, seg)
+	}
+	a.CurrentSegment = a.Segments[1]
+
+	request := httptest.NewRequest(http.MethodGet, "/search?q=panic&before=3&after=1", nil)
+	response := httptest.NewRecorder()
+	srv.Search(response, request)
+
+	var hits []Hit
+	if err := json.NewDecoder(response.Body).Decode(&hits); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(hits) != 1 {
+		t.Fatalf("expected 1 hit, got %d", len(hits))
+	}
+
+	var before []string
+	for _, e := range hits[0].Before {
+		before = append(before, e.Message)
+	}
+	if want := []string{"connect db", "db ready", "request one"}; !slices.Equal(before, want) {
+		t.Errorf("expected before %v, got %v", want, before)
+	}
+	if len(hits[0].After) != 1 || hits[0].After[0].Message != "request two" {
+		t.Errorf("unexpected after context %v", hits[0].After)
+	}
+	if hits[0].Segment != 2 || hits[0].ID != 1 {
+		t.Errorf("expected hit at segment 2 id 1, got %d/%d", hits[0].Segment, hits[0].ID)
+	}
+}
+
+func TestSearchTimeout(t *testing.T) {
+	a := &app.App{
+		Cfg: app.Config{MaxResults: 10, MaxQueryTime: time.Nanosecond},
+		CurrentSegment: &app.Segment{
+			Index: make(map[string]*app.PostingList),
+		},
+	}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	a.CurrentSegment.Logs = []app.LogEntry{{Timestamp: time.Now(), Level: "INFO", Message: "slow query"}}
+	a.Segments = append(a.Segments, a.CurrentSegment)
+	helper.IndexEntry(a.CurrentSegment, 0, a.CurrentSegment.Logs[0], 0)
+	time.Sleep(time.Millisecond)
+
+	t.Run("search flags partial results", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/search?q=slow", nil)
+		response := httptest.NewRecorder()
+		srv.Search(response, request)
+
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected status 200 OK, got %d", response.Code)
+		}
+		if response.Header().Get("X-Timed-Out") != "true" {
+			t.Errorf("expected X-Timed-Out header to be set")
+		}
+		// The body keeps its shape, partial or not
+		var hits []Hit
+		if err := json.NewDecoder(response.Body).Decode(&hits); err != nil {
+			t.Fatalf("expected an array of hits: %v", err)
+		}
+	})
+
+	t.Run("count reports timed_out", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/search?q=slow&count=true", nil)
+		response := httptest.NewRecorder()
+		srv.Search(response, request)
+
+		var res CountResult
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if !res.TimedOut || !res.Approximate {
+			t.Errorf("expected timed out approximate count, got %+v", res)
+		}
+	})
+}
+
+func TestSearchExplain(t *testing.T) {
+	a := &app.App{Cfg: app.Config{MaxResults: 10}}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	now := time.Now()
+	for i, ts := range []time.Time{now.Add(-3 * time.Hour), now} {
+		seg := &app.Segment{Id: i + 1, Index: make(map[string]*app.PostingList)}
+		for id, msg := range []string{"db timeout", "db ready", "payment timeout"} {
+			e := app.LogEntry{Timestamp: ts, Level: "INFO", Message: msg}
+			seg.Logs = append(seg.Logs, e)
+			helper.IndexEntry(seg, id, e, 0)
+		}
+		a.Segments = append(a.Segments, seg)
+	}
+	a.CurrentSegment = a.Segments[1]
+
+	request := httptest.NewRequest(http.MethodGet, "/search?q=DB+timeout&since=1h&explain=true", nil)
+	response := httptest.NewRecorder()
+	srv.Search(response, request)
+
+	var res struct {
+		Hits    []Hit   `json:"hits"`
+		Explain Explain `json:"explain"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if len(res.Hits) != 1 {
+		t.Errorf("expected 1 hit, got %d", len(res.Hits))
+	}
+	ex := res.Explain
+	if ex.Query == nil || ex.Query.Op != helper.OpAnd {
+		t.Errorf("expected parsed and query, got %+v", ex.Query)
+	}
+	if !slices.Equal(ex.Tokens, []string{"db", "timeout"}) {
+		t.Errorf("expected normalised tokens, got %v", ex.Tokens)
+	}
+	if ex.Skipped != 1 || len(ex.Segments) != 2 {
+		t.Fatalf("expected one of two segments skipped, got %+v", ex)
+	}
+	seg := ex.Segments[0] // newest segment is searched first
+	if seg.Segment != 2 || seg.Postings["db"] != 2 || seg.Postings["timeout"] != 2 || seg.IntersectCost != 4 || seg.Matched != 1 {
+		t.Errorf("unexpected segment explain %+v", seg)
+	}
+}
+
+func TestSearchExplainBloom(t *testing.T) {
+	dir := t.TempDir()
+	a := &app.App{Cfg: app.Config{MaxResults: 10, DataPath: dir, Retention: 24 * time.Hour}}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	// Segments 1-3 are only on disk, with bloom filters; the filter of
+	// segment 1 also holds "payment", a false positive. Segment 4 is in
+	// memory, where its filter is not consulted.
+	now := time.Now()
+	for i, msg := range []string{"db timeout", "cache warmed", "payment failed", "db ready"} {
+		e := app.LogEntry{Timestamp: now, Level: "INFO", Message: msg}
+		f := bloom.New(3, 0.01)
+		for _, token := range helper.Tokenize(msg) {
+			f.Add(token)
+		}
+		if i == 0 {
+			f.Add("payment")
+		}
+		if i == 3 {
+			seg := &app.Segment{Id: 4, Index: make(map[string]*app.PostingList), Bloom: f}
+			seg.Logs = append(seg.Logs, e)
+			helper.IndexEntry(seg, 0, e, 0)
+			a.Segments = []*app.Segment{seg}
+			a.CurrentSegment = seg
+			break
+		}
+
+		data, _ := json.Marshal(e)
+		if err := os.WriteFile(helper.SegmentPath(dir, i+1), append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+		data, _ = f.MarshalBinary()
+		if err := helper.WriteSidecar(helper.BloomPath(dir, i+1), data, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/search?q=payment&explain=true", nil)
+	response := httptest.NewRecorder()
+	srv.Search(response, request)
+
+	var res struct {
+		Hits    []Hit   `json:"hits"`
+		Explain Explain `json:"explain"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if len(res.Hits) != 1 || res.Hits[0].Segment != 3 {
+		t.Errorf("expected the hit in segment 3, got %+v", res.Hits)
+	}
+	b := res.Explain.Bloom
+	if b.Checked != 3 || b.Skipped != 1 || b.FalsePositives != 1 || b.FalsePositiveRate != 0.5 {
+		t.Errorf("unexpected bloom explain %+v", b)
+	}
+	for _, se := range res.Explain.Segments {
+		switch se.Segment {
+		case 2:
+			if se.Skipped != "ruled out by bloom filter" {
+				t.Errorf("expected segment 2 skipped by its bloom filter, got %+v", se)
+			}
+		case 4:
+			if se.BloomRate != 0 {
+				t.Errorf("expected no bloom filter checked for the in-memory segment, got %+v", se)
+			}
+		default:
+			if se.BloomRate <= 0 || se.BloomRate > 0.05 {
+				t.Errorf("expected estimated false positive rate for segment %d, got %v", se.Segment, se.BloomRate)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"watchlogs/cmd/helper"
+)
+
+// maxPatternExamples is the number of example entries kept per pattern.
+const maxPatternExamples = 3
+
+// LogRef identifies an entry by its segment and position within it.
+type LogRef struct {
+	Segment int `json:"segment"`
+	ID      int `json:"id"`
+}
+
+// PatternCount is one template in the /patterns response.
+type PatternCount struct {
+	ID       int      `json:"id"`
+	Template string   `json:"template"`
+	Count    int      `json:"count"`
+	Examples []LogRef `json:"examples"`
+}
+
+func (s *Server) Patterns(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt64(&s.App.Metrics.Ready) == 0 {
+		log.Printf("Received patterns request from %s but server is not ready\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("server is not ready, try again later"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		log.Printf("Received non-GET request on /patterns: %s\n", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Printf("Received patterns request from %s with query: %s\n", r.RemoteAddr, r.URL.RawQuery)
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	f := filter{since: helper.ParseSince(r.URL.Query().Get("since"))}
+
+	counts := make(map[int]*PatternCount)
+	s.App.Mu.Lock()
+	for seg := len(s.App.Segments) - 1; seg >= 0; seg-- {
+		segment := s.App.Segments[seg]
+		for id := len(segment.Patterns) - 1; id >= 0; id-- {
+			pid := segment.Patterns[id]
+			if pid == 0 || !f.match(segment, id) {
+				continue
+			}
+			pc := counts[pid]
+			if pc == nil {
+				pc = &PatternCount{ID: pid}
+				counts[pid] = pc
+			}
+			pc.Count++
+			if len(pc.Examples) < maxPatternExamples {
+				pc.Examples = append(pc.Examples, LogRef{Segment: segment.Id, ID: id})
+			}
+		}
+	}
+	s.App.Mu.Unlock()
+
+	result := make([]PatternCount, 0, len(counts))
+	for _, pc := range counts {
+		if t, ok := s.App.Patterns.Get(pc.ID); ok {
+			pc.Template = t.String()
+		}
+		result = append(result, *pc)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].ID < result[j].ID
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
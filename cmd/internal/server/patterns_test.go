@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/patterns"
+)
+
+func TestPatterns(t *testing.T) {
+	a := &app.App{
+		Cfg:      app.Config{MaxResults: 10},
+		Patterns: patterns.NewMiner(),
+		CurrentSegment: &app.Segment{
+			Id:    1,
+			Index: make(map[string]*app.PostingList),
+		},
+	}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	now := time.Now()
+	for i, msg := range []string{
+		"user alice failed login from 10.0.0.1",
+		"cache warmed in 35ms",
+		"user bob failed login from 10.0.0.2",
+		"user carol failed login from 10.0.0.3",
+	} {
+		e := app.LogEntry{Timestamp: now, Level: "WARN", Message: msg}
+		a.CurrentSegment.Logs = append(a.CurrentSegment.Logs, e)
+		a.CurrentSegment.Patterns = append(a.CurrentSegment.Patterns, a.Patterns.Add(msg))
+		helper.IndexEntry(a.CurrentSegment, i, e, 0)
+	}
+	a.Segments = append(a.Segments, a.CurrentSegment)
+
+	request := httptest.NewRequest(http.MethodGet, "/patterns?since=1h", nil)
+	response := httptest.NewRecorder()
+	srv.Patterns(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status 200 OK, got %d", response.Code)
+	}
+	var result []PatternCount
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("expected 2 patterns, got %d", len(result))
+	}
+	top := result[0]
+	if top.Template != "user <*> failed login from <*>" || top.Count != 3 {
+		t.Errorf("unexpected top pattern %+v", top)
+	}
+	if len(top.Examples) != 3 || top.Examples[0] != (LogRef{Segment: 1, ID: 3}) {
+		t.Errorf("expected newest examples first, got %v", top.Examples)
+	}
+
+	t.Run("search filters by pattern", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/search?pattern="+strconv.Itoa(top.ID), nil)
+		response := httptest.NewRecorder()
+		srv.Search(response, request)
+
+		var hits []Hit
+		if err := json.NewDecoder(response.Body).Decode(&hits); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(hits) != 3 {
+			t.Fatalf("expected 3 hits, got %d", len(hits))
+		}
+		for _, h := range hits {
+			if h.Pattern != top.ID {
+				t.Errorf("expected pattern %d, got %d for %q", top.ID, h.Pattern, h.Message)
+			}
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+)
+
+// maxRangePoints matches the resolution limit of Prometheus range queries.
+const maxRangePoints = 11000
+
+// rangeFuncs are the functions that turn a log query into a series.
+var rangeFuncs = map[string]bool{"rate": true, "count_over_time": true}
+
+// promResponse is the Prometheus HTTP API envelope.
+type promResponse struct {
+	Status    string    `json:"status"`
+	Data      *promData `json:"data,omitempty"`
+	ErrorType string    `json:"errorType,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type promData struct {
+	ResultType string       `json:"resultType"`
+	Result     []promSeries `json:"result"`
+}
+
+type promSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]any          `json:"values"`
+}
+
+// QueryRange evaluates a log query as a time series, answering in the
+// shape of the Prometheus /api/v1/query_range API. The query is either a
+// plain log query, counted per step, or wrapped in a function:
+//
+//	rate(level:error "db timeout")            matches per second
+//	count_over_time(level:error "db timeout") matches per step
+//
+// The value at each timestamp t covers the entries in (t-step, t].
+func (s *Server) QueryRange(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt64(&s.App.Metrics.Ready) == 0 {
+		log.Printf("Received query_range request from %s but server is not ready\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("server is not ready, try again later"))
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		log.Printf("Received non-GET/POST request on /query_range: %s\n", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Printf("Received query_range request from %s\n", r.RemoteAddr)
+	badData := func(err error) {
+		writeJSON(w, http.StatusBadRequest, promResponse{Status: "error", ErrorType: "bad_data", Error: err.Error()})
+	}
+
+	fn, inner := splitRangeQuery(r.FormValue("query"))
+	q, err := helper.ParseQuery(inner)
+	if err != nil {
+		badData(err)
+		return
+	}
+
+	start, err := parsePromTime(r.FormValue("start"))
+	if err != nil {
+		badData(fmt.Errorf("invalid start: %v", err))
+		return
+	}
+	end, err := parsePromTime(r.FormValue("end"))
+	if err != nil {
+		badData(fmt.Errorf("invalid end: %v", err))
+		return
+	}
+	step, err := parsePromDuration(r.FormValue("step"))
+	if err != nil || step <= 0 {
+		badData(fmt.Errorf("invalid step"))
+		return
+	}
+	if end.Before(start) {
+		badData(fmt.Errorf("end timestamp must not be before start time"))
+		return
+	}
+	points := int(end.Sub(start)/step) + 1
+	if points > maxRangePoints {
+		badData(fmt.Errorf("exceeded maximum resolution of %d points per series, try a larger step", maxRangePoints))
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	counts := s.rangeCounts(ctx, q, start, step, points)
+
+	if ctx.Err() != nil {
+		writeJSON(w, http.StatusServiceUnavailable, promResponse{Status: "error", ErrorType: "timeout", Error: "query timed out"})
+		return
+	}
+
+	series := promSeries{
+		Metric: map[string]string{"__name__": fn, "query": inner},
+		Values: make([][2]any, points),
+	}
+	for i, n := range counts {
+		t := start.Add(time.Duration(i) * step)
+		v := float64(n)
+		if fn == "rate" {
+			v /= step.Seconds()
+		}
+		series.Values[i] = [2]any{float64(t.UnixMilli()) / 1000, strconv.FormatFloat(v, 'f', -1, 64)}
+	}
+
+	writeJSON(w, http.StatusOK, promResponse{
+		Status: "success",
+		Data:   &promData{ResultType: "matrix", Result: []promSeries{series}},
+	})
+}
+
+// rangeCounts counts the entries matching q in each of the points
+// intervals (t-step, t] with t = start + i*step. Entries after the last
+// point are left out, also when end was not on the step grid.
+func (s *Server) rangeCounts(ctx context.Context, q *helper.Query, start time.Time, step time.Duration, points int) []int {
+	counts := make([]int, points)
+	last := start.Add(time.Duration(points-1) * step)
+	f := filter{since: start.Add(-step), until: last.Add(time.Nanosecond)}
+
+	s.eachSegment(ctx, q, false, nil, func(segment *app.Segment) bool {
+		for _, id := range segmentMatches(ctx, segment, q, f, nil) {
+			ts := segment.Time(id)
+			if !ts.After(f.since) || ts.After(last) {
+				continue
+			}
+			counts[int((ts.Sub(start)+step-1)/step)]++
+		}
+		return true
+	})
+	return counts
+}
+
+// splitRangeQuery separates an optional function call from the log query
+// it wraps. A bare log query counts matches per step.
+func splitRangeQuery(query string) (fn, inner string) {
+	query = strings.TrimSpace(query)
+	if open := strings.Index(query, "("); open > 0 && strings.HasSuffix(query, ")") {
+		name := strings.TrimSpace(query[:open])
+		if rangeFuncs[name] {
+			return name, query[open+1 : len(query)-1]
+		}
+	}
+	return "count_over_time", query
+}
+
+// parsePromTime accepts Unix seconds, possibly fractional, or RFC3339.
+func parsePromTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, fmt.Errorf("missing value")
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// parsePromDuration accepts a duration such as "30s" or a number of
+// seconds.
+func parsePromDuration(v string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	return time.ParseDuration(v)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+)
+
+func TestQueryRange(t *testing.T) {
+	a := &app.App{
+		Cfg: app.Config{MaxResults: 1, Retention: time.Hour},
+		CurrentSegment: &app.Segment{
+			Index: make(map[string]*app.PostingList),
+		},
+	}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	a.CurrentSegment.Logs = []app.LogEntry{
+		{Timestamp: base.Add(10 * time.Second), Level: "ERROR", Message: "db timeout"},
+		{Timestamp: base.Add(20 * time.Second), Level: "INFO", Message: "db timeout retried"},
+		{Timestamp: base.Add(60 * time.Second), Level: "ERROR", Message: "db timeout"},
+		{Timestamp: base.Add(130 * time.Second), Level: "ERROR", Message: "db timeout"},
+	}
+	a.Segments = append(a.Segments, a.CurrentSegment)
+	for i, log := range a.CurrentSegment.Logs {
+		helper.IndexEntry(a.CurrentSegment, i, log, 0)
+	}
+
+	params := url.Values{
+		"query": {`rate(level:error "db timeout")`},
+		"start": {strconv.FormatInt(base.Unix(), 10)},
+		"end":   {base.Add(3 * time.Minute).Format(time.RFC3339)},
+		"step":  {"1m"},
+	}
+	request := httptest.NewRequest(http.MethodGet, "/query_range?"+params.Encode(), nil)
+	response := httptest.NewRecorder()
+	srv.QueryRange(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status 200 OK, got %d: %s", response.Code, response.Body)
+	}
+
+	var res struct {
+		Status string `json:"status"`
+		Data   struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+				Values [][2]any          `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if res.Status != "success" || res.Data.ResultType != "matrix" || len(res.Data.Result) != 1 {
+		t.Fatalf("unexpected response %+v", res)
+	}
+
+	// Each point covers (t-1m, t], so the entry at +60s falls on the +1m point
+	want := []string{"0", strconv.FormatFloat(2.0/60, 'f', -1, 64), "0", strconv.FormatFloat(1.0/60, 'f', -1, 64)}
+	values := res.Data.Result[0].Values
+	if len(values) != len(want) {
+		t.Fatalf("expected %d points, got %d", len(want), len(values))
+	}
+	for i, v := range values {
+		if ts := v[0].(float64); ts != float64(base.Add(time.Duration(i)*time.Minute).Unix()) {
+			t.Errorf("point %d: unexpected timestamp %v", i, ts)
+		}
+		if v[1] != want[i] {
+			t.Errorf("point %d: expected %s, got %v", i, want[i], v[1])
+		}
+	}
+
+	t.Run("unaligned end", func(t *testing.T) {
+		// end = +150s is not on the 1m grid; the entry at +130s lies after
+		// the last point at +120s and must be left out
+		params := url.Values{
+			"query": {`count_over_time(db)`},
+			"start": {strconv.FormatInt(base.Unix(), 10)},
+			"end":   {strconv.FormatInt(base.Add(150*time.Second).Unix(), 10)},
+			"step":  {"60"},
+		}
+		request := httptest.NewRequest(http.MethodGet, "/query_range?"+params.Encode(), nil)
+		response := httptest.NewRecorder()
+		srv.QueryRange(response, request)
+
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected status 200 OK, got %d: %s", response.Code, response.Body)
+		}
+		if !strings.Contains(response.Body.String(), `"values":[[1714557600,"0"],[1714557660,"3"],[1714557720,"0"]]`) {
+			t.Errorf("unexpected response %s", response.Body)
+		}
+
+		// The lock was released, so searches still run
+		done := make(chan struct{})
+		go func() {
+			a.Mu.Lock()
+			a.Mu.Unlock()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("expected App.Mu to be released")
+		}
+	})
+
+	t.Run("invalid step", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/query_range?query=db&start=0&end=60&step=soon", nil)
+		response := httptest.NewRecorder()
+		srv.QueryRange(response, request)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 Bad Request, got %d", response.Code)
+		}
+	})
+}
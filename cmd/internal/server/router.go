@@ -6,6 +6,17 @@ func (s *Server) Router() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ingest", s.Ingest)
 	mux.HandleFunc("/search", s.Search)
+	mux.HandleFunc("/aggregate/histogram", s.AggregateHistogram)
+	mux.HandleFunc("/query_range", s.QueryRange)
+	mux.HandleFunc("/api/v1/query_range", s.QueryRange)
+	mux.HandleFunc("/patterns", s.Patterns)
+	mux.HandleFunc("/terms/top", s.TopTerms)
+	mux.HandleFunc("/export", s.Export)
+	mux.HandleFunc("/saved", s.SavedSearches)
+	mux.HandleFunc("/saved/", s.SavedSearches)
+	mux.HandleFunc("/alerts", s.AlertRules)
+	mux.HandleFunc("/alerts/", s.AlertRules)
+	mux.HandleFunc("/snapshot", s.Snapshot)
 	mux.HandleFunc("/metrics", s.Metrics)
 	mux.HandleFunc("/health", s.Health)
 	mux.HandleFunc("/ready", s.Ready)
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/saved"
+)
+
+// SavedSearches serves the saved search API:
+//
+//	GET    /saved         list saved searches
+//	POST   /saved         create or replace one from the JSON body
+//	GET    /saved/{name}  fetch one
+//	PUT    /saved/{name}  create or replace one
+//	DELETE /saved/{name}  delete one
+//
+// A saved search is run with /search?saved={name}.
+func (s *Server) SavedSearches(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt64(&s.App.Metrics.Ready) == 0 {
+		log.Printf("Received saved search request from %s but server is not ready\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("server is not ready, try again later"))
+		return
+	}
+	if s.App.Saved == nil {
+		http.Error(w, "saved searches are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("Received %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/saved"), "/")
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.App.Saved.List())
+
+	case name == "" && r.Method == http.MethodPost, name != "" && r.Method == http.MethodPut:
+		var search saved.Search
+		if json.NewDecoder(r.Body).Decode(&search) != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		if name != "" {
+			search.Name = name
+		}
+		if err := validateSaved(search); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.App.Saved.Put(search); err != nil {
+			log.Printf("Failed to store saved search %s: %v\n", search.Name, err)
+			http.Error(w, "failed to store saved search", http.StatusInternalServerError)
+			return
+		}
+		search, _ = s.App.Saved.Get(search.Name)
+		writeJSON(w, http.StatusOK, search)
+
+	case name != "" && r.Method == http.MethodGet:
+		search, err := s.App.Saved.Get(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, search)
+
+	case name != "" && r.Method == http.MethodDelete:
+		err := s.App.Saved.Delete(name)
+		if errors.Is(err, saved.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to delete saved search %s: %v\n", name, err)
+			http.Error(w, "failed to delete saved search", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func validateSaved(search saved.Search) error {
+	if search.Name == "" || strings.ContainsAny(search.Name, "/?#& ") {
+		return fmt.Errorf("name is required and cannot contain spaces or URL separators")
+	}
+	if _, err := helper.ParseQuery(search.Query); err != nil {
+		return err
+	}
+	if search.Since != "" {
+		if _, err := time.ParseDuration(search.Since); err != nil {
+			return fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	return nil
+}
+
+// withSaved returns the search parameters of the saved search called name,
+// overridden by any parameter set explicitly in params.
+func (s *Server) withSaved(name string, params url.Values) (url.Values, error) {
+	if s.App.Saved == nil {
+		return nil, saved.ErrNotFound
+	}
+	search, err := s.App.Saved.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := url.Values{}
+	merged.Set("q", search.Query)
+	if search.Level != "" {
+		merged.Set("level", search.Level)
+	}
+	if search.Since != "" {
+		merged.Set("since", search.Since)
+	}
+	for key, values := range params {
+		if key != "saved" {
+			merged[key] = values
+		}
+	}
+	return merged, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
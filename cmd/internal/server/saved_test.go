@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/saved"
+)
+
+func TestSavedSearches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "saved_searches.json")
+	store, err := saved.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+
+	a := &app.App{
+		Cfg:   app.Config{MaxResults: 10},
+		Saved: store,
+		CurrentSegment: &app.Segment{
+			Index: make(map[string]*app.PostingList),
+		},
+	}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+	router := srv.Router()
+
+	now := time.Now()
+	a.CurrentSegment.Logs = []app.LogEntry{
+		{Timestamp: now, Level: "ERROR", Message: "payment declined"},
+		{Timestamp: now, Level: "INFO", Message: "payment accepted"},
+	}
+	a.Segments = append(a.Segments, a.CurrentSegment)
+	for i, log := range a.CurrentSegment.Logs {
+		helper.IndexEntry(a.CurrentSegment, i, log, 0)
+	}
+
+	do := func(method, target string, body any) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(method, target, &buf))
+		return response
+	}
+
+	res := do(http.MethodPut, "/saved/payment-errors", saved.Search{Query: "payment", Level: "error", Since: "1h"})
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200 OK, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := do(http.MethodPost, "/saved", saved.Search{Name: "broken", Query: "(payment"}); res.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid query to be rejected, got %d", res.Code)
+	}
+
+	var list []saved.Search
+	json.NewDecoder(do(http.MethodGet, "/saved", nil).Body).Decode(&list)
+	if len(list) != 1 || list[0].Name != "payment-errors" {
+		t.Fatalf("unexpected saved searches %+v", list)
+	}
+
+	t.Run("run saved search", func(t *testing.T) {
+		var hits []Hit
+		json.NewDecoder(do(http.MethodGet, "/search?saved=payment-errors", nil).Body).Decode(&hits)
+		if len(hits) != 1 || hits[0].Message != "payment declined" {
+			t.Errorf("unexpected hits %+v", hits)
+		}
+	})
+
+	t.Run("override saved filters", func(t *testing.T) {
+		var hits []Hit
+		json.NewDecoder(do(http.MethodGet, "/search?saved=payment-errors&level=info", nil).Body).Decode(&hits)
+		if len(hits) != 1 || hits[0].Message != "payment accepted" {
+			t.Errorf("unexpected hits %+v", hits)
+		}
+	})
+
+	t.Run("persisted across reopen", func(t *testing.T) {
+		reopened, err := saved.Open(path)
+		if err != nil {
+			t.Fatalf("failed to reopen store: %v", err)
+		}
+		if s, err := reopened.Get("payment-errors"); err != nil || s.Level != "error" {
+			t.Errorf("expected persisted saved search, got %+v, %v", s, err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if res := do(http.MethodDelete, "/saved/payment-errors", nil); res.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204 No Content, got %d", res.Code)
+		}
+		if res := do(http.MethodGet, "/search?saved=payment-errors", nil); res.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 Not Found, got %d", res.Code)
+		}
+	})
+}
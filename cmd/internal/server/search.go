@@ -0,0 +1,411 @@
+package server
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/bloom"
+)
+
+// Supported values of the sort query parameter.
+const (
+	SortTimeDesc  = "time_desc"
+	SortTimeAsc   = "time_asc"
+	SortRelevance = "relevance"
+)
+
+// Hit is a single search result. Score is only set for relevance sorting,
+// Highlights only when highlighting was requested and Before/After only
+// when context lines were requested.
+type Hit struct {
+	app.LogEntry
+	Segment    int            `json:"segment"`
+	ID         int            `json:"id"`
+	Pattern    int            `json:"pattern,omitempty"`
+	Score      float64        `json:"score,omitempty"`
+	Highlights []helper.Span  `json:"highlights,omitempty"`
+	Before     []app.LogEntry `json:"before,omitempty"`
+	After      []app.LogEntry `json:"after,omitempty"`
+}
+
+// filter holds the restrictions of a search that are not answered by the
+// inverted index.
+type filter struct {
+	since   time.Time
+	until   time.Time // exclusive, zero means no upper bound
+	level   string
+	pattern int
+}
+
+func (f filter) match(segment *app.Segment, id int) bool {
+	ts := segment.Time(id)
+	if !f.since.IsZero() && ts.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !ts.Before(f.until) {
+		return false
+	}
+	if f.level != "" && !strings.EqualFold(segment.Level(id), f.level) {
+		return false
+	}
+	if f.pattern != 0 && (id >= len(segment.Patterns) || segment.Patterns[id] != f.pattern) {
+		return false
+	}
+	return true
+}
+
+// excludes reports whether the time bounds of f rule out every entry of
+// segment, so it can be skipped without touching its index.
+func (f filter) excludes(segment *app.Segment) bool {
+	if segment.Len() == 0 {
+		return true
+	}
+	if !f.since.IsZero() && segment.MaxTime.Before(f.since) {
+		return true
+	}
+	return !f.until.IsZero() && !segment.MinTime.Before(f.until)
+}
+
+// Explain describes how a search was executed.
+type Explain struct {
+	Query    *helper.Node     `json:"query"`
+	Tokens   []string         `json:"tokens"`
+	Segments []SegmentExplain `json:"segments"`
+	Skipped  int              `json:"skipped"`
+	Bloom    BloomExplain     `json:"bloom"`
+	Duration string           `json:"duration"`
+
+	bloomRates map[int]float64 // estimated rate of each bloom filter checked, by segment
+}
+
+// BloomExplain sums up the bloom filter checks of a search. A false
+// positive is a segment its filter let through although its index holds
+// none of the tokens needed; FalsePositiveRate is the share of such
+// segments among all that could not match.
+type BloomExplain struct {
+	Checked           int     `json:"checked"`
+	Skipped           int     `json:"skipped"`
+	FalsePositives    int     `json:"falsePositives"`
+	FalsePositiveRate float64 `json:"falsePositiveRate"`
+}
+
+// SegmentExplain is the work done on one segment. BloomRate is the
+// estimated false positive rate of its bloom filter, if it was checked.
+type SegmentExplain struct {
+	Segment   int     `json:"segment"`
+	Entries   int     `json:"entries"`
+	BloomRate float64 `json:"bloomRate,omitempty"`
+	Skipped   string  `json:"skipped,omitempty"`
+	helper.MatchStats
+	Matched  int    `json:"matched"`
+	Duration string `json:"duration"`
+}
+
+func newExplain(q *helper.Query) *Explain {
+	ex := &Explain{Tokens: q.Tokens(), Segments: []SegmentExplain{}, bloomRates: make(map[int]float64)}
+	if q != nil {
+		ex.Query = q.Root
+	}
+	return ex
+}
+
+// segmentMatches returns the IDs of the entries in segment matching q, in
+// write order, or nil when the time bounds of f exclude the segment. If
+// ctx is done part way the IDs found so far are returned. When ex is not
+// nil the work done is recorded in it.
+func segmentMatches(ctx context.Context, segment *app.Segment, q *helper.Query, f filter, ex *Explain) []int {
+	if ex == nil {
+		if f.excludes(segment) {
+			return nil
+		}
+		return q.Match(ctx, segment, nil).IDs()
+	}
+
+	started := time.Now()
+	se := SegmentExplain{Segment: segment.Id, Entries: segment.Len(), BloomRate: ex.bloomRates[segment.Id]}
+	if f.excludes(segment) {
+		se.Skipped = "outside time bounds"
+		ex.Skipped++
+		ex.Segments = append(ex.Segments, se)
+		return nil
+	}
+
+	se.Postings = make(map[string]int)
+	ids := q.Match(ctx, segment, &se.MatchStats).IDs()
+	se.Matched = len(ids)
+	se.Duration = time.Since(started).String()
+	ex.Segments = append(ex.Segments, se)
+	return ids
+}
+
+// check records the check of a segment's bloom filter f for q and reports
+// whether the segment may match.
+func (b *BloomExplain) check(q *helper.Query, f *bloom.Filter) bool {
+	b.Checked++
+	pass := q.MayMatch(f)
+	if !pass {
+		b.Skipped++
+		b.updateRate()
+	}
+	return pass
+}
+
+// falsePositive records that a segment let through by its filter turned
+// out to hold none of the tokens needed once read.
+func (b *BloomExplain) falsePositive() {
+	b.FalsePositives++
+	b.updateRate()
+}
+
+func (b *BloomExplain) updateRate() {
+	b.FalsePositiveRate = float64(b.FalsePositives) / float64(b.Skipped+b.FalsePositives)
+}
+
+// hit builds the search result for entry id of segment.
+func hit(segment *app.Segment, id int) Hit {
+	h := Hit{LogEntry: segment.Entry(id), Segment: segment.Id, ID: id}
+	if id < len(segment.Patterns) {
+		h.Pattern = segment.Patterns[id]
+	}
+	return h
+}
+
+// search collects up to MaxResults hits in the requested order. It stops
+// between segments once ctx is done, returning the hits found so far. ex
+// may be nil. Segments that are no longer in memory are searched too, see
+// eachSegment.
+func (s *Server) search(ctx context.Context, q *helper.Query, f filter, order string, ex *Explain) []Hit {
+	limit := s.App.Cfg.MaxResults
+	tokens := q.Tokens()
+	var hits []Hit
+
+	switch order {
+	case SortTimeAsc:
+		s.eachSegment(ctx, q, false, ex, func(segment *app.Segment) bool {
+			for _, id := range segmentMatches(ctx, segment, q, f, ex) {
+				if len(hits) >= limit {
+					break
+				}
+				if f.match(segment, id) {
+					hits = append(hits, hit(segment, id))
+				}
+			}
+			return len(hits) < limit
+		})
+
+	case SortRelevance:
+		s.eachSegment(ctx, q, false, ex, func(segment *app.Segment) bool {
+			for _, id := range segmentMatches(ctx, segment, q, f, ex) {
+				if !f.match(segment, id) {
+					continue
+				}
+				h := hit(segment, id)
+				h.Score = helper.BM25(segment, tokens, h.LogEntry)
+				hits = append(hits, h)
+			}
+			return true
+		})
+		sort.SliceStable(hits, func(i, j int) bool {
+			if hits[i].Score != hits[j].Score {
+				return hits[i].Score > hits[j].Score
+			}
+			return hits[i].Timestamp.After(hits[j].Timestamp)
+		})
+		if len(hits) > limit {
+			hits = hits[:limit]
+		}
+
+	default:
+		s.eachSegment(ctx, q, true, ex, func(segment *app.Segment) bool {
+			matched := segmentMatches(ctx, segment, q, f, ex)
+			for i := len(matched) - 1; i >= 0 && len(hits) < limit; i-- {
+				if f.match(segment, matched[i]) {
+					hits = append(hits, hit(segment, matched[i]))
+				}
+			}
+			return len(hits) < limit
+		})
+	}
+
+	return hits
+}
+
+// eachSegment calls visit with every segment, oldest first or, when desc
+// is set, newest first, until visit returns false or ctx is done. The
+// in-memory segments are held for the whole walk and visited with App.Mu
+// held. Older sealed segments, on local disk or in the blob store, are
+// read one at a time without it, see readCold. ex may be nil.
+func (s *Server) eachSegment(ctx context.Context, q *helper.Query, desc bool, ex *Explain, visit func(segment *app.Segment) bool) {
+	hot, release := s.holdSegments()
+	defer release()
+	below := -1
+	if len(hot) > 0 {
+		below = hot[0].Id
+	}
+	cold := helper.ColdSegmentIDs(s.App, below)
+	if desc {
+		slices.Reverse(hot)
+		slices.Reverse(cold)
+	}
+
+	visitHot := func() bool {
+		for _, segment := range hot {
+			if ctx.Err() != nil {
+				return false
+			}
+			s.App.Mu.Lock()
+			more := visit(segment)
+			s.App.Mu.Unlock()
+			if !more {
+				return false
+			}
+		}
+		return true
+	}
+	visitCold := func() bool {
+		for _, id := range cold {
+			if ctx.Err() != nil {
+				return false
+			}
+			if segment := s.readCold(ctx, q, id, ex); segment != nil && !visit(segment) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if desc {
+		if visitHot() {
+			visitCold()
+		}
+	} else if visitCold() {
+		visitHot()
+	}
+}
+
+// holdSegments returns the in-memory segments, held so that compaction,
+// retention or eviction cannot empty them while they are in use without
+// App.Mu. release lets go of them.
+func (s *Server) holdSegments() (hot []*app.Segment, release func()) {
+	s.App.Mu.Lock()
+	hot = append([]*app.Segment(nil), s.App.Segments...)
+	holds := make([]func(), len(hot))
+	for i, seg := range hot {
+		holds[i] = seg.Hold()
+	}
+	s.App.Mu.Unlock()
+	return hot, func() {
+		s.App.Mu.Lock()
+		for _, done := range holds {
+			done()
+		}
+		s.App.Mu.Unlock()
+	}
+}
+
+// readCold reads segment id, which is no longer in memory, from local disk
+// or the blob store, leaving out entries past their retention. Its bloom
+// filter is checked first, and nil is returned without opening the
+// segment when the filter rules q out. When ex is not nil the check is
+// recorded in it.
+func (s *Server) readCold(ctx context.Context, q *helper.Query, id int, ex *Explain) *app.Segment {
+	filter, err := helper.LoadBloom(ctx, s.App, id)
+	if err != nil {
+		log.Printf("Failed to read the bloom filter of segment %d: %v\n", id, err)
+	}
+	if filter != nil && ex != nil {
+		ex.bloomRates[id] = filter.FalsePositiveRate()
+		if !ex.Bloom.check(q, filter) {
+			ex.Skipped++
+			ex.Segments = append(ex.Segments, SegmentExplain{Segment: id, BloomRate: ex.bloomRates[id], Skipped: "ruled out by bloom filter"})
+			return nil
+		}
+	} else if !q.MayMatch(filter) {
+		return nil
+	}
+
+	seg := &app.Segment{Id: id}
+	data, err := helper.OpenSegmentData(ctx, s.App, id)
+	if err != nil {
+		log.Printf("Failed to open segment %d: %v\n", id, err)
+		return seg
+	}
+	defer data.Close()
+	if err := helper.ReadSegmentFrom(seg, data, helper.Retained(s.App.Cfg, time.Now()), nil, s.App.Keys); err != nil {
+		log.Printf("Failed to read segment %d: %v\n", id, err)
+	}
+	if ex != nil && filter != nil && !q.MayMatch(helper.IndexTokens(seg.Index)) {
+		ex.Bloom.falsePositive()
+	}
+	return seg
+}
+
+// CountResult is the response of a count-only search.
+type CountResult struct {
+	Count       int                       `json:"count"`
+	Approximate bool                      `json:"approximate"`
+	TimedOut    bool                      `json:"timed_out,omitempty"`
+	Facets      map[string]map[string]int `json:"facets,omitempty"`
+	Explain     *Explain                  `json:"explain,omitempty"`
+}
+
+// count counts every match without the MaxResults cap and tallies the
+// values of the facet fields. The count is approximate when a posting
+// list it relied on was trimmed by MaxPerToken, or when ctx ended the
+// count early. ex may be nil. Like search it covers the segments that
+// are no longer in memory.
+func (s *Server) count(ctx context.Context, q *helper.Query, f filter, facets []string, ex *Explain) CountResult {
+	res := CountResult{Explain: ex}
+	tokens := q.Tokens()
+	if len(facets) > 0 {
+		res.Facets = make(map[string]map[string]int, len(facets))
+		for _, name := range facets {
+			res.Facets[name] = make(map[string]int)
+		}
+	}
+
+	s.eachSegment(ctx, q, false, ex, func(segment *app.Segment) bool {
+		for _, t := range tokens {
+			if segment.Index[t].Truncated() {
+				res.Approximate = true
+			}
+		}
+
+		for _, id := range segmentMatches(ctx, segment, q, f, ex) {
+			if !f.match(segment, id) {
+				continue
+			}
+			res.Count++
+			if len(facets) == 0 {
+				continue
+			}
+			e := segment.Entry(id)
+			for _, name := range facets {
+				if v, ok := facetValue(&e, name); ok {
+					res.Facets[name][v]++
+				}
+			}
+		}
+		return true
+	})
+	if ctx.Err() != nil {
+		res.Approximate = true
+	}
+	return res
+}
+
+// facetValue returns the value of a facet for e. "level" is the entry's
+// level, any other name is looked up in its structured fields.
+func facetValue(e *app.LogEntry, name string) (string, bool) {
+	if name == "level" {
+		return strings.ToLower(e.Level), e.Level != ""
+	}
+	v, ok := e.Fields[name]
+	return v, ok
+}
@@ -1,21 +1,17 @@
 package server
 
 import (
-	"bufio"
-	"encoding/json"
-	"fmt"
 	"log"
-	"os"
-	"path/filepath"
-	"sort"
 	"time"
 
 	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/alert"
 	"watchlogs/cmd/internal/app"
 )
 
 type Server struct {
-	App *app.App
+	App    *app.App
+	Alerts *alert.Manager
 }
 
 func New(a *app.App) *Server {
@@ -24,27 +20,16 @@ func New(a *app.App) *Server {
 
 func (s *Server) LoadFromDisk() {
 	log.Println("Loading logs from disk...")
+	helper.RecoverCompaction(s.App.Cfg.DataPath)
+	defer s.reconcileManifest()
 
-	entries, err := os.ReadDir(s.App.Cfg.DataPath)
+	segIDs, err := helper.ListSegments(s.App.Cfg.DataPath)
 	if err != nil {
 		log.Printf("Failed to read data directory %s: %v\n", s.App.Cfg.DataPath, err)
 	}
 
-	var segIDs []int
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		var id int
-		_, err := fmt.Sscanf(entry.Name(), "seg-%06d.log", &id)
-		if err == nil {
-			segIDs = append(segIDs, id)
-		}
-	}
-
-	sort.Ints(segIDs)
 	if len(segIDs) == 0 {
-		seg, err := helper.OpenSegment(1, s.App.Cfg.DataPath)
+		seg, err := helper.OpenSegment(1, s.App.Cfg.DataPath, s.App.Keys)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -54,53 +39,37 @@ func (s *Server) LoadFromDisk() {
 	}
 
 	hotCount := max(s.App.Cfg.HotSegments, 1)
-	start := max(len(segIDs) - hotCount, 0)
+	start := max(len(segIDs)-hotCount, 0)
 	segIDs = segIDs[start:]
 
 	var hotSegments []*app.Segment
 	for i, id := range segIDs {
-		seg, err := helper.OpenSegment(id, s.App.Cfg.DataPath)
+		seg, err := helper.OpenSegment(id, s.App.Cfg.DataPath, s.App.Keys)
 		if err != nil {
 			log.Printf("Failed to open segment %d: %v\n", id, err)
 			continue
 		}
 
 		seg.Logs = nil
-		seg.Index = make(map[string][]int)
-
-		file, err := os.Open(filepath.Join(s.App.Cfg.DataPath, fmt.Sprintf("seg-%06d.log", id)))
-		if err != nil {
-			log.Printf("Failed to scan segment %d: %v\n", id, err)
-			seg.File.Close()
-			continue
-		}
-
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			var entry app.LogEntry
-			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
-				continue
-			}
-			cutoff := time.Now().Add(-s.App.Cfg.Retention)
-			if entry.Timestamp.After(cutoff) {
-				logID := len(seg.Logs)
-				seg.Logs = append(seg.Logs, entry)
-
-				for _, token := range helper.Tokenize(entry.Message) {
-					seg.Index[token] = append(seg.Index[token], logID)
-				}
-			}
-		}
-		file.Close()
+		seg.Index = make(map[string]*app.PostingList)
 
+		// Sealed segments stay in their files, mapped, and only the one
+		// being written is read into memory
+		keep := helper.Retained(s.App.Cfg, time.Now())
+		path := helper.SegmentPath(s.App.Cfg.DataPath, id)
+		read := helper.ReadSegment
 		if i < len(segIDs)-1 {
 			seg.File.Close()
+			read = helper.MapSegment
+		}
+		if err := read(seg, path, keep, s.App.Patterns, s.App.Keys); err != nil {
+			log.Printf("Failed to scan segment %d, keeping %d entries read: %v\n", id, seg.Len(), err)
 		}
 		hotSegments = append(hotSegments, seg)
 	}
 
 	if len(hotSegments) == 0 {
-		seg, err := helper.OpenSegment(1, s.App.Cfg.DataPath)
+		seg, err := helper.OpenSegment(1, s.App.Cfg.DataPath, s.App.Keys)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -112,3 +81,15 @@ func (s *Server) LoadFromDisk() {
 	s.App.Segments = hotSegments
 	s.App.CurrentSegment = hotSegments[len(hotSegments)-1]
 }
+
+// reconcileManifest checks the manifest against the segment files loaded
+// and logs every discrepancy before rebuilding it.
+func (s *Server) reconcileManifest() {
+	problems, err := helper.ReconcileManifest(s.App.Cfg.DataPath, s.App.CurrentSegment.Id, s.App.Keys)
+	for _, p := range problems {
+		log.Printf("Manifest discrepancy: %s\n", p)
+	}
+	if err != nil {
+		log.Printf("Failed to reconcile the segment manifest: %v\n", err)
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"slices"
 	"testing"
 	"time"
@@ -11,16 +12,18 @@ import (
 )
 
 func TestServer(t *testing.T) {
-	tempfile, err := os.CreateTemp("", "logs.txt")
+	dir := t.TempDir()
+	tempfile, err := os.Create(filepath.Join(dir, "seg-000001.log"))
 	if err != nil {
 		t.Fatalf("failed to create temp file: %v", err)
 	}
-	defer os.Remove(tempfile.Name())
 	defer tempfile.Close()
+	cfg := helper.LoadConfig()
+	cfg.DataPath = dir
 	a := &app.App{
-		Cfg: helper.LoadConfig(),
+		Cfg: cfg,
 		CurrentSegment: &app.Segment{
-			Index: make(map[string][]int),
+			Index: make(map[string]*app.PostingList),
 		},
 	}
 	srv := New(a)
@@ -73,7 +76,7 @@ func TestServer(t *testing.T) {
 				t.Errorf("expected token %s to exist in index", token)
 				continue
 			}
-			found := slices.Contains(ids, i)
+			found := slices.Contains(ids.IDs(), i)
 			if !found {
 				t.Errorf("expected log ID %d to be indexed under token %s", i, token)
 			}
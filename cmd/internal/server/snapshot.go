@@ -0,0 +1,67 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"watchlogs/cmd/helper"
+)
+
+// SnapshotInfo describes a snapshot taken with POST /snapshot.
+type SnapshotInfo struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Segments int    `json:"segments"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// Snapshot serves the snapshot API:
+//
+//	GET  /snapshot  list snapshot names
+//	POST /snapshot  take a snapshot of every segment
+//
+// A snapshot is restored into an empty data directory with
+// `watchlogs restore`.
+func (s *Server) Snapshot(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt64(&s.App.Metrics.Ready) == 0 {
+		log.Printf("Received snapshot request from %s but server is not ready\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("server is not ready, try again later"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		names := []string{}
+		entries, _ := os.ReadDir(filepath.Join(s.App.Cfg.DataPath, helper.SnapshotDir))
+		for _, e := range entries {
+			if e.IsDir() {
+				names = append(names, e.Name())
+			}
+		}
+		writeJSON(w, http.StatusOK, names)
+
+	case http.MethodPost:
+		log.Printf("Received snapshot request from %s\n", r.RemoteAddr)
+		dir, m, err := helper.Snapshot(s.App)
+		if err != nil {
+			log.Printf("Snapshot failed: %v\n", err)
+			http.Error(w, "snapshot failed", http.StatusInternalServerError)
+			return
+		}
+
+		info := SnapshotInfo{Name: filepath.Base(dir), Path: dir, Segments: len(m.Segments)}
+		for _, seg := range m.Segments {
+			info.Bytes += seg.Size
+		}
+		log.Printf("Snapshot %s taken with %d segments\n", info.Name, info.Segments)
+		writeJSON(w, http.StatusCreated, info)
+
+	default:
+		log.Printf("Received %s request on /snapshot\n", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+)
+
+// TermCount is one token in the /terms/top response. Previous and Ratio
+// are only set in rising mode.
+type TermCount struct {
+	Term     string  `json:"term"`
+	Count    int     `json:"count"`
+	Previous int     `json:"previous,omitempty"`
+	Ratio    float64 `json:"ratio,omitempty"`
+}
+
+func (s *Server) TopTerms(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt64(&s.App.Metrics.Ready) == 0 {
+		log.Printf("Received top terms request from %s but server is not ready\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("server is not ready, try again later"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		log.Printf("Received non-GET request on /terms/top: %s\n", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Printf("Received top terms request from %s with query: %s\n", r.RemoteAddr, r.URL.RawQuery)
+	query := r.URL.Query()
+
+	limit := 20
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	var result []TermCount
+	switch query.Get("mode") {
+	case "", "top":
+		f := filter{since: helper.ParseSince(query.Get("since")), level: query.Get("level")}
+
+		s.App.Mu.Lock()
+		counts := s.countTerms(f)
+		s.App.Mu.Unlock()
+
+		for term, n := range counts {
+			result = append(result, TermCount{Term: term, Count: n})
+		}
+		sort.Slice(result, func(i, j int) bool {
+			if result[i].Count != result[j].Count {
+				return result[i].Count > result[j].Count
+			}
+			return result[i].Term < result[j].Term
+		})
+
+	case "rising":
+		// Compare the last window with the window just before it
+		window := time.Hour
+		if v := query.Get("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid window", http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+		now := time.Now()
+		level := query.Get("level")
+
+		s.App.Mu.Lock()
+		current := s.countTerms(filter{since: now.Add(-window), level: level})
+		previous := s.countTerms(filter{since: now.Add(-2 * window), until: now.Add(-window), level: level})
+		s.App.Mu.Unlock()
+
+		for term, n := range current {
+			prev := previous[term]
+			result = append(result, TermCount{
+				Term:     term,
+				Count:    n,
+				Previous: prev,
+				Ratio:    float64(n+1) / float64(prev+1),
+			})
+		}
+		sort.Slice(result, func(i, j int) bool {
+			if result[i].Ratio != result[j].Ratio {
+				return result[i].Ratio > result[j].Ratio
+			}
+			return result[i].Term < result[j].Term
+		})
+
+	default:
+		http.Error(w, "mode must be top or rising", http.StatusBadRequest)
+		return
+	}
+
+	if len(result) > limit {
+		result = result[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// countTerms returns how many entries matching f contain each token,
+// skipping stopwords. Segments entirely inside the filter are answered
+// from posting list sizes, except for terms whose list was trimmed by
+// MaxPerToken; those and the other segments are tokenized entry by entry.
+// The caller must hold App.Mu.
+func (s *Server) countTerms(f filter) map[string]int {
+	counts := make(map[string]int)
+	stop := s.App.Cfg.Stopwords
+
+	for _, segment := range s.App.Segments {
+		if segment.Len() == 0 {
+			continue
+		}
+
+		// scan is nil to count every term, otherwise the terms to count
+		var scan map[string]bool
+		if covers(segment, f) {
+			scan = make(map[string]bool)
+			for term, ids := range segment.Index {
+				switch {
+				case stop[term]:
+				case ids.Truncated():
+					scan[term] = true
+				default:
+					counts[term] += ids.Len()
+				}
+			}
+			if len(scan) == 0 {
+				continue
+			}
+		}
+
+		for id := range segment.Len() {
+			if !f.match(segment, id) {
+				continue
+			}
+			seen := make(map[string]bool)
+			for _, term := range helper.Tokenize(segment.Entry(id).Message) {
+				if !stop[term] && !seen[term] && (scan == nil || scan[term]) {
+					seen[term] = true
+					counts[term]++
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// covers reports whether every entry of segment passes f, so that its
+// index can be used as is.
+func covers(segment *app.Segment, f filter) bool {
+	if f.level != "" || f.pattern != 0 {
+		return false
+	}
+	if !f.since.IsZero() && segment.MinTime.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !segment.MaxTime.Before(f.until) {
+		return false
+	}
+	return true
+}
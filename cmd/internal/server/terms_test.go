@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/app"
+)
+
+func TestTopTerms(t *testing.T) {
+	a := &app.App{
+		Cfg: app.Config{Stopwords: map[string]bool{"the": true}},
+		CurrentSegment: &app.Segment{
+			Index: make(map[string]*app.PostingList),
+		},
+	}
+	srv := New(a)
+	atomic.StoreInt64(&srv.App.Metrics.Ready, 1)
+
+	now := time.Now()
+	a.CurrentSegment.Logs = []app.LogEntry{
+		{Timestamp: now.Add(-90 * time.Minute), Level: "INFO", Message: "the request served"},
+		{Timestamp: now.Add(-80 * time.Minute), Level: "INFO", Message: "the request served"},
+		{Timestamp: now.Add(-20 * time.Minute), Level: "ERROR", Message: "the deadlock detected"},
+		{Timestamp: now.Add(-10 * time.Minute), Level: "ERROR", Message: "deadlock detected deadlock"},
+		{Timestamp: now.Add(-5 * time.Minute), Level: "INFO", Message: "request served"},
+	}
+	a.Segments = append(a.Segments, a.CurrentSegment)
+	for i, log := range a.CurrentSegment.Logs {
+		helper.IndexEntry(a.CurrentSegment, i, log, 0)
+	}
+
+	get := func(t *testing.T, query string) []TermCount {
+		request := httptest.NewRequest(http.MethodGet, "/terms/top?"+query, nil)
+		response := httptest.NewRecorder()
+		srv.TopTerms(response, request)
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected status 200 OK, got %d", response.Code)
+		}
+		var result []TermCount
+		if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return result
+	}
+
+	t.Run("top terms skip stopwords", func(t *testing.T) {
+		result := get(t, "limit=2")
+		if len(result) != 2 || result[0].Term != "request" || result[0].Count != 3 {
+			t.Errorf("unexpected top terms %+v", result)
+		}
+		for _, tc := range result {
+			if tc.Term == "the" {
+				t.Errorf("stopword returned: %+v", tc)
+			}
+		}
+	})
+
+	t.Run("top terms by level and since", func(t *testing.T) {
+		result := get(t, "since=30m&level=error")
+		if len(result) != 2 || result[0].Term != "deadlock" || result[0].Count != 2 {
+			t.Errorf("unexpected top terms %+v", result)
+		}
+	})
+
+	t.Run("rising terms", func(t *testing.T) {
+		result := get(t, "mode=rising&window=1h")
+		if len(result) == 0 || result[0].Term != "deadlock" && result[0].Term != "detected" {
+			t.Fatalf("expected a new error keyword to rise first, got %+v", result)
+		}
+		if result[0].Previous != 0 || result[0].Count != 2 {
+			t.Errorf("unexpected rising counts %+v", result[0])
+		}
+	})
+}
+
+func TestTopTermsTruncated(t *testing.T) {
+	a := &app.App{
+		CurrentSegment: &app.Segment{
+			Index: make(map[string]*app.PostingList),
+		},
+	}
+	srv := New(a)
+	a.Segments = append(a.Segments, a.CurrentSegment)
+
+	// With at most 2 IDs per token the list of "request" is trimmed
+	for i, msg := range []string{"request served", "request served", "request failed", "disk full"} {
+		e := app.LogEntry{Timestamp: time.Now(), Message: msg}
+		a.CurrentSegment.Logs = append(a.CurrentSegment.Logs, e)
+		helper.IndexEntry(a.CurrentSegment, i, e, 2)
+	}
+
+	counts := srv.countTerms(filter{})
+	if counts["request"] != 3 || counts["served"] != 2 || counts["disk"] != 1 {
+		t.Errorf("expected exact counts despite trimmed posting lists, got %v", counts)
+	}
+}
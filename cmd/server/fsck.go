@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"watchlogs/cmd/helper"
+
+	"github.com/joho/godotenv"
+)
+
+// fsck runs the fsck subcommand and returns the exit code: 0 when the data
+// directory is healthy or was repaired, 1 when problems remain, 2 on error.
+func fsck(args []string) int {
+	godotenv.Load() // optional here, DATA_PATH may come from the environment
+
+	cfg := helper.LoadConfig()
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	dir := fs.String("data", cfg.DataPath, "data directory to check")
+	repair := fs.Bool("repair", false, "truncate torn tails and quarantine bad data; stop the server first")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: watchlogs fsck [--data dir] [--repair]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	keys := loadKeyring(cfg) // to check the entries of encrypted segments
+
+	report, err := helper.Fsck(*dir, *repair, keys)
+	if report != nil {
+		for _, p := range report.Problems {
+			fmt.Println(p)
+		}
+		for _, r := range report.Repaired {
+			fmt.Println("repaired:", r)
+		}
+		fmt.Printf("%d segments, %d entries, %d problems\n", report.Segments, report.Entries, len(report.Problems))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fsck:", err)
+		return 2
+	}
+	if len(report.Problems) > 0 && !*repair {
+		return 1
+	}
+	return 0
+}
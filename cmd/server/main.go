@@ -5,18 +5,33 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"watchlogs/cmd/helper"
+	"watchlogs/cmd/internal/alert"
 	"watchlogs/cmd/internal/app"
+	"watchlogs/cmd/internal/blob"
+	"watchlogs/cmd/internal/crypt"
+	"watchlogs/cmd/internal/patterns"
+	"watchlogs/cmd/internal/saved"
 	"watchlogs/cmd/internal/server"
 
 	"github.com/joho/godotenv"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			os.Exit(fsck(os.Args[2:]))
+		case "restore":
+			os.Exit(restore(os.Args[2:]))
+		}
+	}
+
 	log.Println("Server started...")
 
 	err := godotenv.Load()
@@ -33,9 +48,23 @@ func main() {
 
 	// Initialize the app with the current segment and configuration
 	a := &app.App{
-		// Index: make(map[string][]int),
-		LogCh: make(chan app.LogEntry, cfg.ChannelSize),
-		Cfg:   cfg,
+		LogCh:    make(chan app.LogEntry, cfg.ChannelSize),
+		Cfg:      cfg,
+		Patterns: patterns.NewMiner(),
+	}
+
+	// Saved searches live next to the segments
+	a.Saved, err = saved.Open(filepath.Join(cfg.DataPath, "saved_searches.json"))
+	if err != nil {
+		log.Fatalf("Failed to load saved searches: %v\n", err)
+	}
+
+	// Sealed segments past WARM_AGE move to the blob store
+	if cfg.BlobStore != "" {
+		a.Blobs, err = blob.Open(cfg.BlobStore, cfg.S3)
+		if err != nil {
+			log.Fatalf("Failed to open blob store: %v\n", err)
+		}
 	}
 
 	// Set server start time for metrics
@@ -43,6 +72,17 @@ func main() {
 
 	srv := server.New(a)
 
+	// Alert rules are evaluated on every committed entry and on a timer
+	srv.Alerts, err = alert.NewManager(cfg.AlertRules)
+	if err != nil {
+		log.Fatalf("Failed to load alert rules: %v\n", err)
+	}
+	a.Observers = append(a.Observers, srv.Alerts)
+	go srv.Alerts.Run(cfg.AlertInterval)
+
+	// Segments are encrypted at rest when keys are configured
+	a.Keys = loadKeyring(cfg)
+
 	// Load existing logs from disk into memory
 	srv.LoadFromDisk()
 
@@ -67,6 +107,26 @@ func main() {
 	// Log rotation to remove unwanted old logs
 	go helper.Cleanup(a)
 
+	// Merge small sealed segments left behind by rotation and retention
+	go helper.Compactor(a)
+
+	// Disk quota and low-disk watermark
+	helper.CheckDisk(a)
+	go helper.WatchDisk(a)
+
 	log.Println("server running on :8080")
 	log.Fatal(http.ListenAndServe(":8080", srv.Router()))
 }
+
+// loadKeyring loads the encryption keys from ENCRYPTION_KEY_FILE or
+// ENCRYPTION_KEYS, if any. Without keys new segments are plaintext.
+func loadKeyring(cfg app.Config) *crypt.Keyring {
+	keys, err := crypt.Load(cfg.KeyFile, os.Getenv("ENCRYPTION_KEYS"))
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %v\n", err)
+	}
+	if keys != nil {
+		log.Printf("Encrypting new segments with key %s\n", keys.Active())
+	}
+	return keys
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"watchlogs/cmd/helper"
+
+	"github.com/joho/godotenv"
+)
+
+// restore runs the restore subcommand, rebuilding a data directory from a
+// snapshot taken with POST /snapshot.
+func restore(args []string) int {
+	godotenv.Load() // optional here, DATA_PATH may come from the environment
+
+	cfg := helper.LoadConfig()
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("data", cfg.DataPath, "data directory to restore into; must hold no segments")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: watchlogs restore [--data dir] <snapshot dir>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	keys := loadKeyring(cfg) // to check the entries of encrypted segments
+
+	if err := helper.Restore(fs.Arg(0), *dir, keys); err != nil {
+		fmt.Fprintln(os.Stderr, "restore:", err)
+		return 1
+	}
+	fmt.Printf("restored %s into %s\n", fs.Arg(0), *dir)
+	return 0
+}